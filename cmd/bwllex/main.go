@@ -0,0 +1,157 @@
+/*
+	Generates Go source for a lexer, so that the regular expressions don't
+	have to be parsed and the DFA doesn't have to be built every time a
+	program starts.
+
+	    $ bwllex -p calc -o scanner.go calc.lex
+
+	The rules file is in the format that lexer.LoadSpec reads: one rule per
+	line, giving the name of the token and then the regular expression that
+	matches it. Blank lines, and lines beginning with #, are skipped. Leading
+	and trailing spaces are not part of the expression; use \  if one is
+	needed. Macros, skip rules and modes are written like so:
+
+	    # a calculator
+	    DIGIT   = [0-9]
+	    NUMBER  {DIGIT}+(\.{DIGIT}+)?
+	    OP      [-+*%]
+	    SPACE   [ \t\n]+        -> skip
+	    QUOTE   "               -> push string
+
+	    %mode string
+	    TEXT    [^"]+
+	    QUOTE   "               -> pop
+
+	Tokens are numbered in the order their names first appear, which also
+	decides which rule wins when two match the same input, so a rule for a
+	name given earlier beats one for a later name, wherever it comes in the
+	file. The output declares a constant for each token, along with a
+	Scanner type that behaves like lexer.Lexer, passing over the tokens that
+	are skipped. The constants FAIL and EOF are declared too. To put two scanners in one package, give
+	them different type names (-t) and constant prefixes (-c):
+
+	    $ bwllex -p calc -t CalcScanner -c Calc -o scanner.go calc.lex
+
+	which declares CalcNUMBER, CalcFAIL and so on.
+*/
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/format"
+	"go/token"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/bobappleyard/bwl/errors"
+	"github.com/bobappleyard/bwl/lexer"
+)
+
+// The identifiers the generated code declares or relies upon at the top
+// level, given the name of the scanner type.
+func declared(typ string) []string {
+	lower := strings.ToLower(typ[:1]) + typ[1:]
+	res := []string{
+		typ, "bufio", "io", "strings",
+		"append", "copy", "len", "make", "nil", "true", "false",
+		"bool", "int", "int32", "rune", "string",
+	}
+	for _, x := range []string{"State", "States", "Class", "Classes", "NumClasses", "Next", "Skip", "Modes"} {
+		res = append(res, lower+x)
+	}
+	return res
+}
+
+func compile(name string, in io.Reader, typ, prefix string) (*lexer.Table, *lexer.Names, error) {
+	l, names, err := lexer.LoadSpec(in)
+	if err, ok := err.(*lexer.SpecError); ok {
+		return nil, nil, fmt.Errorf("%s:%d: %s", name, err.Line, err.Err)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, reserved := range []string{"FAIL", "EOF"} {
+		if _, ok := names.ID(reserved); ok {
+			return nil, nil, fmt.Errorf("%s: token name %s is reserved", name, reserved)
+		}
+	}
+	taken := declared(typ)
+	for i := 0; i < names.Len(); i++ {
+		id := prefix + names.Name(i)
+		if token.IsKeyword(id) {
+			return nil, nil, fmt.Errorf("%s: token name %s is a Go keyword", name, id)
+		}
+		if slices.Contains(taken, id) {
+			return nil, nil, fmt.Errorf("%s: token name %s is used by the generated code", name, id)
+		}
+	}
+	t, err := l.Table()
+	return t, names, err
+}
+
+func generate(w io.Writer, source, pkg, typ, prefix string, names *lexer.Names, t *lexer.Table) error {
+	tokens := make([]string, names.Len())
+	skip := make([]bool, names.Len())
+	for i := range tokens {
+		tokens[i] = names.Name(i)
+		skip[i] = names.Skipped(i)
+	}
+	next := make([][]int, len(t.States))
+	for i := range next {
+		next[i] = t.Next[i*t.NumClasses : (i+1)*t.NumClasses]
+	}
+	var buf bytes.Buffer
+	err := scannerTemplate.Execute(&buf, map[string]interface{}{
+		"Source":  source,
+		"Package": pkg,
+		"Type":    typ,
+		"Prefix":  prefix,
+		"Lower":   strings.ToLower(typ[:1]) + typ[1:],
+		"Names":   tokens,
+		"Skip":    skip,
+		"Table":   t,
+		"Next":    next,
+	})
+	if err != nil {
+		return err
+	}
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(src)
+	return err
+}
+
+func main() {
+	pkg := flag.String("p", "main", "package name for the generated code")
+	typ := flag.String("t", "Scanner", "name of the generated scanner type")
+	prefix := flag.String("c", "", "prefix for the names of the generated constants")
+	out := flag.String("o", "", "output file (default stdout)")
+	flag.Parse()
+	if flag.NArg() != 1 || !token.IsIdentifier(*typ) || *prefix != "" && !token.IsIdentifier(*prefix) {
+		fmt.Fprintln(os.Stderr, "usage: bwllex [-p package] [-t type] [-c prefix] [-o output] rules")
+		os.Exit(2)
+	}
+
+	name := flag.Arg(0)
+	f, err := os.Open(name)
+	errors.Fatal(err)
+	t, names, err := compile(name, f, *typ, *prefix)
+	f.Close()
+	errors.Fatal(err)
+
+	w := io.Writer(os.Stdout)
+	if *out != "" {
+		f, err := os.Create(*out)
+		errors.Fatal(err)
+		defer f.Close()
+		w = f
+	}
+	errors.Fatal(generate(w, name, *pkg, *typ, *prefix, names, t))
+}
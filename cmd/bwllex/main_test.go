@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bobappleyard/bwl/lexer"
+)
+
+// modes, skip rules and trailing context
+const testSpec = `
+DIGIT   = [0-9]
+NUMBER  {DIGIT}+(\.{DIGIT}+)?
+RANGE   {DIGIT}+/\.\.
+DOTS    \.\.
+OP      [-+*%]
+SPACE   [ \t\n]+        -> skip
+QUOTE   "               -> push string
+
+%mode string
+TEXT    [^"]+
+QUOTE   "               -> pop
+`
+
+// prints the tokens in each argument, as lexer.Token does
+const testMain = `package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func main() {
+	var s Scanner
+	if s.Next() != FAIL {
+		panic("not started")
+	}
+	for _, arg := range os.Args[1:] {
+		s.StartString(arg)
+		for id := s.Next(); id != EOF; id = s.Next() {
+			fmt.Printf("%d %q\n", id, s.String())
+			if id == FAIL {
+				break
+			}
+		}
+	}
+}
+`
+
+func TestGenerate(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds the generated code")
+	}
+	table, names, err := compile("test.lex", strings.NewReader(testSpec), "Scanner", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var src bytes.Buffer
+	if err := generate(&src, "test.lex", "main", "Scanner", "", names, table); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"go.mod":     "module scanner\n\ngo 1.21\n",
+		"scanner.go": src.String(),
+		"main.go":    testMain,
+	}
+	for name, text := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(text), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	inputs := []string{`1..2 + 3.5`, `"a b" % "" 4`, `1 ! 2`, `12.`}
+	cmd := exec.Command("go", append([]string{"run", "."}, inputs...)...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s\n%s", err, out)
+	}
+
+	// the same tokens as the Lexer finds
+	l, _, err := lexer.LoadSpec(strings.NewReader(testSpec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want strings.Builder
+	for _, in := range inputs {
+		l.StartString(in)
+		for tok, err := range l.Tokens() {
+			if err != nil {
+				want.WriteString("-1 \"\"\n")
+				break
+			}
+			fmt.Fprintf(&want, "%d %q\n", tok.ID, tok.Text)
+		}
+	}
+	if string(out) != want.String() {
+		t.Errorf("got:\n%s\nwant:\n%s", out, want.String())
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	for spec, msg := range map[string]string{
+		"EOF x":         "reserved",
+		"if x":          "Go keyword",
+		"len x":         "used by the generated code",
+		"scannerNext x": "used by the generated code",
+		// assertions can't go in a table
+		"A x\nB \\bx": "",
+	} {
+		_, _, err := compile("test.lex", strings.NewReader(spec), "Scanner", "")
+		if err == nil || !strings.Contains(err.Error(), msg) {
+			t.Errorf("%q: %v", spec, err)
+		}
+	}
+	if _, _, err := compile("test.lex", strings.NewReader("if x"), "Scanner", "Tok"); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"text/template"
+)
+
+var scannerTemplate = template.Must(template.New("scanner").Parse(`// Code generated by bwllex from {{.Source}}. DO NOT EDIT.
+
+package {{.Package}}
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+const (
+	{{.Prefix}}FAIL = -1
+	{{.Prefix}}EOF  = -2
+)
+
+const (
+{{- range $i, $n := .Names}}
+	{{$.Prefix}}{{$n}} = {{$i}}
+{{- end}}
+)
+
+type {{.Lower}}State struct {
+	final     int
+	pop, push bool
+	mode      string
+	// how many runes of trailing context to give back
+	trail int
+}
+
+var {{.Lower}}States = [...]{{.Lower}}State{
+{{- range .Table.States}}
+	{ {{- .Final}}, {{.Pop}}, {{.Push}}, {{printf "%q" .Mode}}, {{.Trail -}} },
+{{- end}}
+}
+
+// runes are put into classes, and each state treats the runes in a class
+// alike
+type {{.Lower}}Class struct {
+	lo, hi rune
+	class  int
+}
+
+var {{.Lower}}Classes = [...]{{.Lower}}Class{
+{{- range .Table.Classes}}
+	{ {{- .Lo}}, {{.Hi}}, {{.Class -}} },
+{{- end}}
+}
+
+const {{.Lower}}NumClasses = {{.Table.NumClasses}}
+
+// where each state goes on each class
+var {{.Lower}}Next = [...]int32{
+{{- range .Next}}
+	{{range .}}{{.}}, {{end}}
+{{- end}}
+}
+
+// whether each token is passed over
+var {{.Lower}}Skip = [...]bool{ {{- range .Skip}}{{.}}, {{end -}} }
+
+var {{.Lower}}Modes = map[string]int{
+{{- range $k, $v := .Table.Modes}}
+	{{printf "%q" $k}}: {{$v}},
+{{- end}}
+}
+
+// Splits its input up into tokens, in the same way as lexer.Lexer.
+type {{.Type}} struct {
+	src           *bufio.Reader
+	buf           []rune
+	base          int
+	pos, startPos int
+	eof           bool
+	stack         []string
+}
+
+func (self *{{.Type}}) Start(src io.Reader) {
+	self.src = bufio.NewReader(src)
+	self.buf = make([]rune, 0)
+	self.base = 0
+	self.pos = 0
+	self.eof = false
+	self.stack = []string{""}
+}
+
+func (self *{{.Type}}) StartString(src string) {
+	self.Start(strings.NewReader(src))
+}
+
+func (self *{{.Type}}) get(pos int) rune {
+	for pos-self.base >= len(self.buf) {
+		if self.src == nil {
+			return {{.Prefix}}FAIL
+		}
+		c, _, err := self.src.ReadRune()
+		if err != nil {
+			if err == io.EOF {
+				self.eof = true
+			}
+			self.src = nil
+			return {{.Prefix}}FAIL
+		}
+		self.buf = append(self.buf, c)
+	}
+	return self.buf[pos-self.base]
+}
+
+func (self *{{.Type}}) discard() {
+	n := self.pos - self.base
+	if n < 4096 || n < len(self.buf)/2 {
+		return
+	}
+	self.buf = append(make([]rune, 0, 2*(len(self.buf)-n)), self.buf[n:]...)
+	self.base += n
+}
+
+func (self *{{.Type}}) Next() int {
+	for {
+		depth, mode := len(self.stack), self.CurrentMode()
+		id := self.next()
+		if id >= 0 && self.Len() == 0 && len(self.stack) == depth && self.CurrentMode() == mode {
+			// an empty match that leaves the mode alone would only be found
+			// again
+			if self.Eof() {
+				return {{.Prefix}}EOF
+			}
+			return {{.Prefix}}FAIL
+		}
+		if id < 0 || !{{.Lower}}Skip[id] {
+			return id
+		}
+	}
+}
+
+func (self *{{.Type}}) next() int {
+	if self.Eof() {
+		return {{.Prefix}}EOF
+	}
+	if self.src == nil && !self.eof {
+		return {{.Prefix}}FAIL
+	}
+	self.discard()
+	self.startPos = self.pos
+	state, ok := {{.Lower}}Modes[self.CurrentMode()]
+	if !ok {
+		return {{.Prefix}}FAIL
+	}
+	var rule *{{.Lower}}State
+	fin, end := {{.Prefix}}FAIL, -1
+	for pos := self.pos; ; pos++ {
+		this := &{{.Lower}}States[state]
+		if this.final != {{.Prefix}}FAIL {
+			rule, fin, end = this, this.final, pos
+		}
+		c := self.get(pos)
+		if c == {{.Prefix}}FAIL {
+			break
+		}
+		// find the class c is in
+		classes := {{.Lower}}Classes[:]
+		lo, hi := 0, len(classes)
+		for lo < hi {
+			mid := (lo + hi) / 2
+			if classes[mid].hi < c {
+				lo = mid + 1
+			} else {
+				hi = mid
+			}
+		}
+		if lo == len(classes) || classes[lo].lo > c {
+			break
+		}
+		next := {{.Lower}}Next[state*{{.Lower}}NumClasses+classes[lo].class]
+		if next == {{.Prefix}}FAIL {
+			break
+		}
+		state = int(next)
+	}
+	if fin == {{.Prefix}}FAIL && self.Eof() {
+		// there turned out to be nothing left
+		return {{.Prefix}}EOF
+	}
+	if fin != {{.Prefix}}FAIL {
+		self.pos = end - rule.trail
+		if rule.pop {
+			self.PopMode()
+		}
+		if rule.push {
+			self.PushMode(rule.mode)
+		}
+	}
+	return fin
+}
+
+// Whether the input has been used up.
+func (self *{{.Type}}) Eof() bool {
+	return self.eof && self.pos >= self.base+len(self.buf)
+}
+
+func (self *{{.Type}}) Pos() int {
+	return self.startPos
+}
+
+func (self *{{.Type}}) Len() int {
+	return self.pos - self.startPos
+}
+
+func (self *{{.Type}}) Data() []rune {
+	return self.buf[self.startPos-self.base : self.pos-self.base]
+}
+
+func (self *{{.Type}}) String() string {
+	return string(self.Data())
+}
+
+// The name of the mode the scanner is in.
+func (self *{{.Type}}) CurrentMode() string {
+	if len(self.stack) == 0 {
+		// not started yet
+		return ""
+	}
+	return self.stack[len(self.stack)-1]
+}
+
+// The names of the modes on the stack, with the current mode last.
+func (self *{{.Type}}) Modes() []string {
+	res := make([]string, len(self.stack))
+	copy(res, self.stack)
+	return res
+}
+
+// Enter a mode.
+func (self *{{.Type}}) PushMode(name string) {
+	self.stack = append(self.stack, name)
+}
+
+// Go back to the previous mode. The default mode is never left.
+func (self *{{.Type}}) PopMode() {
+	if len(self.stack) > 1 {
+		self.stack = self.stack[:len(self.stack)-1]
+	}
+}
+`))
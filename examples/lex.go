@@ -2,11 +2,12 @@
 	Demonstrating use of the lexer.
 
 	Takes a list of regular expressions from the command line, and then
-	processes stdin until eof or failure to match to any of the expressions.
+	processes stdin until eof.
 
 	For every match, some information is printed out: the index of the
 	expression in the list passed in, the position in the input for the
-	match, and the text of the match
+	match, and the text of the match. Input that doesn't match any of the
+	expressions is reported, along with where it was found, and then skipped.
 */
 
 package main
@@ -25,12 +26,17 @@ func main() {
 	for i, x := range os.Args[1:] {
 		l.ForceRegex(x, nil).SetFinal(i)
 	}
+	l.SetRecover(true)
 	l.Start(os.Stdin)
 	for !l.Eof() {
 		f := l.Next()
-		if f == -1 {
-			bwlerrors.Fatal(errors.New("failed to match"))
+		switch f {
+		case lexer.FAIL:
+			bwlerrors.Fatal(errors.New("failed to read input"))
+		case lexer.ERROR:
+			fmt.Printf("error at %s: %#v\n", l.Span().Start, l.String())
+		default:
+			fmt.Printf("%d (%2d): %#v\n", f, l.Pos(), l.String())
 		}
-		fmt.Printf("%d (%2d): %#v\n", f, l.Pos(), l.String())
 	}
 }
@@ -0,0 +1,63 @@
+package lexer
+
+/* Actions */
+
+// Something to do when a rule matches. An Action is given the token that was
+// matched, and returns it with its ID and Value changed as need be: the ID to
+// tell a keyword from an identifier, say, or SKIP to have the Lexer drop the
+// token and carry on to the next one, and the Value to hold a number parsed
+// from the text. Anything else about the token is left as it was. If an
+// Action returns an error, Next() returns FAIL, and the error can be had from
+// Err().
+type Action func(tok Token) (Token, error)
+
+// Have the Lexer run an action when it finishes on this state. The action only
+// runs if the state has been made final with SetFinal.
+func (self *BasicState) SetAction(a Action) {
+	self.action = a
+}
+
+func (self *Scanner) act(a Action, id int) int {
+	tok, err := a(Token{ID: id, Text: self.String(), Span: self.Span()})
+	if err != nil {
+		self.err = err
+		return FAIL
+	}
+	self.value = tok.Value
+	return tok.ID
+}
+
+// The value an action gave the current token, if any.
+func (self *Scanner) Value() any {
+	return self.value
+}
+
+// An action that drops the token, for whitespace and comments.
+func Skip(tok Token) (Token, error) {
+	tok.ID = SKIP
+	return tok, nil
+}
+
+// An action that makes the token's value from its text, e.g.
+// Convert(strconv.Atoi) or Convert(strconv.Unquote).
+func Convert[T any](f func(string) (T, error)) Action {
+	return func(tok Token) (Token, error) {
+		v, err := f(tok.Text)
+		if err != nil {
+			return tok, err
+		}
+		tok.Value = v
+		return tok, nil
+	}
+}
+
+// An action that gives the token a different ID if its text is one of the
+// keys in ids.
+func Keywords(ids map[string]int) Action {
+	return func(tok Token) (Token, error) {
+		if id, ok := ids[tok.Text]; ok {
+			tok.ID = id
+		}
+		return tok, nil
+	}
+}
@@ -0,0 +1,157 @@
+package lexer
+
+import (
+	"fmt"
+	"sort"
+	"unicode"
+)
+
+/* Checking rules */
+
+// What Analyse found out about a Lexer's rules.
+type Analysis struct {
+	// rules that can never be the one that matches, as everything they match
+	// is matched by a rule with a lower identifier too
+	Unreachable []Rule
+	// pairs of rules that match some of the same input
+	Overlaps []Overlap
+}
+
+// A rule, by the mode it is in and the identifier its final states have.
+type Rule struct {
+	Mode string
+	ID   int
+}
+
+// Two rules in a mode that can both match Example. Where they do, the one
+// with the lower identifier, Winner, is the one that gets matched.
+type Overlap struct {
+	Mode          string
+	Winner, Loser int
+	Example       string
+}
+
+func (self Overlap) String() string {
+	return fmt.Sprintf("%d and %d both match %q", self.Winner, self.Loser, self.Example)
+}
+
+// Look for rules that get in each other's way. The DFA for each mode is
+// worked out in full, and each of its states tells which rules match the
+// input that leads there. Examples are as short as they can be. Assertions
+// are taken to hold everywhere, so rules that use them may be reported as
+// overlapping when they don't in practice. States from outside this package
+// can't be looked into, and cause an error.
+func (self *Lexer) Analyse() (*Analysis, error) {
+	var err error
+	for _, root := range self.modes {
+		walk(root, func(s State) {
+			if !cacheable(s) {
+				err = fmt.Errorf("states of type %T cannot be analysed", s)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	names := make([]string, 0, len(self.modes))
+	for name := range self.modes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	res := new(Analysis)
+	for _, name := range names {
+		analyseMode(res, name, self.modes[name])
+	}
+	return res, nil
+}
+
+func analyseMode(res *Analysis, mode string, root *BasicState) {
+	// every rule in the mode, and whether it ever wins
+	wins := make(map[int]bool)
+	walk(root, func(s State) {
+		if f := s.Final(); f != FAIL {
+			wins[f] = false
+		}
+	})
+	found := make(map[[2]int]bool)
+
+	d := newDfa()
+	seen := make(map[string]bool)
+	sets := [][]State{}
+	examples := [][]rune{}
+	add := func(set []State, example []rune) {
+		key := d.key(set)
+		if seen[key] {
+			return
+		}
+		seen[key] = true
+		sets = append(sets, set)
+		examples = append(examples, example)
+	}
+
+	// going through the states breadth first finds the shortest examples
+	add(close([]State{root}, nil), nil)
+	for i := 0; i < len(sets); i++ {
+		set, example := sets[i], examples[i]
+		ids := finals(set)
+		if len(ids) != 0 {
+			wins[ids[0]] = true
+		}
+		for j, a := range ids {
+			for _, b := range ids[j+1:] {
+				if !found[[2]int{a, b}] {
+					found[[2]int{a, b}] = true
+					res.Overlaps = append(res.Overlaps, Overlap{mode, a, b, string(example)})
+				}
+			}
+		}
+		bounds := boundaries(set)
+		for j := 0; j < len(bounds)-1; j++ {
+			lo, hi := bounds[j], bounds[j+1]-1
+			if next := move(set, lo); len(next) != 0 {
+				c := exampleRune(lo, hi)
+				add(close(next, nil), append(example[:len(example):len(example)], c))
+			}
+		}
+	}
+
+	start := len(res.Overlaps) - len(found)
+	sort.Slice(res.Overlaps[start:], func(i, j int) bool {
+		a, b := res.Overlaps[start+i], res.Overlaps[start+j]
+		return a.Winner < b.Winner || a.Winner == b.Winner && a.Loser < b.Loser
+	})
+	ids := make([]int, 0, len(wins))
+	for id, ok := range wins {
+		if !ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		res.Unreachable = append(res.Unreachable, Rule{mode, id})
+	}
+}
+
+// The distinct identifiers of the final states in a set, lowest first.
+func finals(set []State) []int {
+	seen := make(map[int]bool)
+	res := []int{}
+	for _, x := range set {
+		if f := x.Final(); f != FAIL && !seen[f] {
+			seen[f] = true
+			res = append(res, f)
+		}
+	}
+	sort.Ints(res)
+	return res
+}
+
+// A rune from a range to use in an example, preferring one that can be seen.
+func exampleRune(lo, hi rune) rune {
+	for c := lo; c <= hi && c < lo+256; c++ {
+		if unicode.IsGraphic(c) {
+			return c
+		}
+	}
+	return lo
+}
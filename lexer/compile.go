@@ -0,0 +1,341 @@
+package lexer
+
+import (
+	"errors"
+	"fmt"
+	"unicode"
+)
+
+/* Building states from syntax trees */
+
+// Add the states for a syntax tree, starting from this state. Returns the
+// state that the tree finishes on, which can then be made final.
+func (self *BasicState) AddTree(n Node) (*BasicState, error) {
+	if t, ok := n.(Trailing); ok {
+		return self.addTrailing(t)
+	}
+	start, end, err := fragment(n, 1)
+	if err != nil {
+		return nil, err
+	}
+	self.AddEmptyTransition(start)
+	return end, nil
+}
+
+// Build the states for a node, which the nodes around it repeat the given
+// number of times. Nothing leads into the start state other than what the
+// caller adds, and nothing leads out of the end state, so that the fragment
+// can be copied and repeated.
+func fragment(n Node, times int) (*BasicState, *BasicState, error) {
+	start, end := NewState(), NewState()
+	switch n := n.(type) {
+	case Literal:
+		start.AddTransition(n.Char, end)
+		if n.Fold {
+			for f := unicode.SimpleFold(n.Char); f != n.Char; f = unicode.SimpleFold(f) {
+				start.AddTransition(f, end)
+			}
+		}
+	case AnyChar:
+		start.AddEmptyTransition(Any(end))
+	case Class:
+		cs, err := classState(n, end)
+		if err != nil {
+			return nil, nil, err
+		}
+		start.AddEmptyTransition(cs)
+	case Anchor:
+		start.AddEmptyTransition(Assert(n.Kind, end))
+	case Concat:
+		last := start
+		for _, x := range n {
+			s, e, err := fragment(x, times)
+			if err != nil {
+				return nil, nil, err
+			}
+			last.AddEmptyTransition(s)
+			last = e
+		}
+		last.AddEmptyTransition(end)
+	case Alt:
+		for _, x := range n {
+			s, e, err := fragment(x, times)
+			if err != nil {
+				return nil, nil, err
+			}
+			start.AddEmptyTransition(s)
+			e.AddEmptyTransition(end)
+		}
+	case Group:
+		s, e, err := fragment(n.Sub, times)
+		if err != nil {
+			return nil, nil, err
+		}
+		start.AddEmptyTransition(&capState{[]State{s}, n.Index, false, n.Name})
+		e.AddEmptyTransition(&capState{[]State{end}, n.Index, true, n.Name})
+	case Repeat:
+		if err := checkRepeat(n.Min, n.Max); err != nil {
+			return nil, nil, err
+		}
+		// the counts of nested repeats multiply (the parser checks this too,
+		// but trees can come from elsewhere)
+		times *= n.count()
+		if times > maxRepeat {
+			return nil, nil, errors.New("nested repeat counts too large")
+		}
+		s, e, err := fragment(n.Sub, times)
+		if err != nil {
+			return nil, nil, err
+		}
+		s, e = repeat(s, e, n.Min, n.Max, n.Lazy)
+		return s, e, nil
+	case Trailing:
+		return nil, nil, errors.New("trailing context can only come at the top of an expression")
+	default:
+		return nil, nil, fmt.Errorf("unknown node type: %T", n)
+	}
+	return start, end, nil
+}
+
+// The states for trailing context. Where the context begins is marked as the
+// end of group 0, the match as a whole, so that it can be found again. Where
+// the context is always the same length, the end state records that, and
+// there's no need to.
+func (self *BasicState) addTrailing(t Trailing) (*BasicState, error) {
+	s, e, err := fragment(t.Sub, 1)
+	if err != nil {
+		return nil, err
+	}
+	cs, ce, err := fragment(t.Context, 1)
+	if err != nil {
+		return nil, err
+	}
+	self.AddEmptyTransition(s)
+	e.AddEmptyTransition(&capState{[]State{cs}, 0, true, ""})
+	ce.trail = FAIL
+	if n, ok := width(t.Context); ok {
+		ce.trail = n
+	}
+	return ce, nil
+}
+
+// How many runes a node always matches, if it's always the same.
+func width(n Node) (int, bool) {
+	switch n := n.(type) {
+	case Literal, AnyChar, Class:
+		return 1, true
+	case Anchor:
+		return 0, true
+	case Concat:
+		res := 0
+		for _, x := range n {
+			w, ok := width(x)
+			if !ok {
+				return 0, false
+			}
+			res += w
+		}
+		return res, true
+	case Alt:
+		res := FAIL
+		for _, x := range n {
+			w, ok := width(x)
+			if !ok || res != FAIL && w != res {
+				return 0, false
+			}
+			res = w
+		}
+		return res, res != FAIL
+	case Repeat:
+		w, ok := width(n.Sub)
+		if !ok || n.Min != n.Max && w != 0 {
+			return 0, false
+		}
+		return w * n.Min, true
+	case Group:
+		return width(n.Sub)
+	}
+	return 0, false
+}
+
+// Make the state for a charset.
+func classState(c Class, next State) (*csState, error) {
+	set, err := classSet(c)
+	if err != nil {
+		return nil, err
+	}
+	res := new(csState)
+	res.SetNext(next)
+	res.set = set
+	return res, nil
+}
+
+// Work out which runes a charset holds.
+func classSet(c Class) (runeSet, error) {
+	rs := make([]runeRange, 0, len(c.Ranges))
+	for _, r := range c.Ranges {
+		if r.Hi < r.Lo {
+			return nil, fmt.Errorf("invalid range specification: %s", Class{Ranges: []ClassRange{r}})
+		}
+		rs = append(rs, runeRange{r.Lo, r.Hi})
+	}
+	res := makeSet(rs)
+	for _, name := range c.In {
+		t := unicodeTable(name)
+		if t == nil {
+			return nil, fmt.Errorf("unknown unicode class: %s", name)
+		}
+		res = res.union(tableSet(t))
+	}
+	for _, name := range c.Out {
+		t := unicodeTable(name)
+		if t == nil {
+			return nil, fmt.Errorf("unknown unicode class: %s", name)
+		}
+		res = res.union(tableSet(t).invert())
+	}
+	for _, x := range c.Nested {
+		set, err := classSet(x)
+		if err != nil {
+			return nil, err
+		}
+		res = res.union(set)
+	}
+	for _, op := range c.Ops {
+		set, err := classSet(op.Class)
+		if err != nil {
+			return nil, err
+		}
+		switch op.Op {
+		case Intersect:
+			res = res.intersect(set)
+		case Subtract:
+			res = res.subtract(set)
+		default:
+			return nil, fmt.Errorf("unknown set operation: %d", op.Op)
+		}
+	}
+	if c.Fold {
+		res = res.fold()
+	}
+	if c.Negate {
+		res = res.invert()
+	}
+	return res, nil
+}
+
+// Copies parts of the graph. What has been copied so far is remembered, so
+// that loops and shared states come out the same way in the copy.
+type copier map[State]State
+
+func (self copier) copyAll(ss []State) []State {
+	res := make([]State, len(ss))
+	for i, x := range ss {
+		res[i] = self.copy(x)
+	}
+	return res
+}
+
+func (self copier) copy(s State) State {
+	if res, ok := self[s]; ok {
+		return res
+	}
+	switch s := s.(type) {
+	case *BasicState:
+		res := NewState()
+		self[s] = res
+		for c, x := range s.transitions {
+			res.transitions[c] = self.copy(x)
+		}
+		res.empty = self.copyAll(s.empty)
+		res.final = s.final
+		res.change = s.change
+		res.action = s.action
+		res.trail = s.trail
+		return res
+	case *SpecialState:
+		res := new(SpecialState)
+		self[s] = res
+		res.next = self.copyAll(s.next)
+		return res
+	case *csState:
+		res := new(csState)
+		*res = *s
+		self[s] = res
+		res.next = self.copyAll(s.next)
+		return res
+	case *capState:
+		res := new(capState)
+		*res = *s
+		self[s] = res
+		res.next = self.copyAll(s.next)
+		return res
+	case *assertState:
+		res := new(assertState)
+		*res = *s
+		self[s] = res
+		res.next = self.copyAll(s.next)
+		return res
+	}
+	// no idea how to copy it, so share it
+	return s
+}
+
+// Make a copy of the part of the graph that runs from start to end.
+func copyFragment(start, end *BasicState) (*BasicState, *BasicState) {
+	c := copier{end: NewState()}
+	return c.copy(start).(*BasicState), c[end].(*BasicState)
+}
+
+// Expand the part of the graph running from start to end so that it matches
+// between min and max times (max < 0 for no limit). Returns the new start and
+// end. The order of the empty transitions decides which way the choices go
+// when matching leftmost-first: a greedy repetition prefers another go round,
+// and a lazy one prefers to stop.
+func repeat(start, end *BasicState, min, max int, lazy bool) (*BasicState, *BasicState) {
+	entry, out := NewState(), NewState()
+	if max == 0 {
+		// cut the whole thing out
+		entry.AddEmptyTransition(out)
+		return entry, out
+	}
+	count := max
+	if max < 0 {
+		count = min
+		if count == 0 {
+			count = 1
+		}
+	}
+	starts, ends := []*BasicState{start}, []*BasicState{end}
+	for len(starts) < count {
+		s, e := copyFragment(start, end)
+		starts = append(starts, s)
+		ends = append(ends, e)
+	}
+	choose := func(from *BasicState, again State) {
+		if lazy {
+			from.AddEmptyTransition(out)
+			from.AddEmptyTransition(again)
+		} else {
+			from.AddEmptyTransition(again)
+			from.AddEmptyTransition(out)
+		}
+	}
+	before := entry
+	for i := 0; i < count; i++ {
+		// the copies after the minimum are optional
+		if i >= min {
+			choose(before, starts[i])
+		} else {
+			before.AddEmptyTransition(starts[i])
+		}
+		before = ends[i]
+	}
+	if max < 0 {
+		// the last copy may repeat indefinitely
+		choose(before, starts[count-1])
+	} else {
+		before.AddEmptyTransition(out)
+	}
+	return entry, out
+}
@@ -0,0 +1,229 @@
+package lexer
+
+import (
+	"encoding/binary"
+	"slices"
+	"sort"
+	"sync/atomic"
+)
+
+/* Lazily constructed DFA */
+
+// The DFA is built by subset construction as the input demands it, in the
+// style of RE2. Each DFA state stands for a closed set of NFA states, and its
+// transitions are filled in the first time a rune is seen in that state.
+//
+// Sets that contain states from outside this package are stepped through
+// without being cached, as there is no telling what their Move and Close
+// methods depend upon.
+
+// the cache is thrown away once it gets this big
+const maxDfaStates = 10000
+
+// The DFAs that have cached sets holding a state, which have to start again
+// when it is modified. Only the states that can be modified need them.
+type watchers []*dfa
+
+func (self *watchers) watch(d *dfa) {
+	if !slices.Contains(*self, d) {
+		*self = append(*self, d)
+	}
+}
+
+func (self watchers) touch() {
+	for _, d := range self {
+		d.stale.Store(true)
+	}
+}
+
+type dfaState struct {
+	set []State
+	// the final state with the lowest identifier, and that identifier
+	rule  State
+	final int
+	cache bool
+	next  map[rune]*dfaEdge
+}
+
+// Where the NFA states reached by a transition include an assertion, which
+// DFA state comes next depends upon the rune that follows, so there's one for
+// each class of rune.
+type dfaEdge struct {
+	ctx  bool
+	to   [ctxClasses]*dfaState
+	done [ctxClasses]bool
+}
+
+func (self *dfaEdge) get(peek func() rune) (*dfaState, int, bool) {
+	cls := 0
+	if self.ctx {
+		cls = class(peek())
+	}
+	return self.to[cls], cls, self.done[cls]
+}
+
+func (self *dfaEdge) set(ctx *context, to *dfaState) {
+	cls := 0
+	if ctx.peeked {
+		self.ctx = true
+		cls = class(ctx.next)
+	}
+	self.to[cls] = to
+	self.done[cls] = true
+}
+
+type startKey struct {
+	root State
+	prev int
+}
+
+type dfa struct {
+	// a frozen DFA's states never change, so it never needs to start again
+	frozen bool
+	stale  atomic.Bool
+	ids    map[State]int
+	states map[string]*dfaState
+	starts map[startKey]*dfaEdge
+}
+
+func newDfa() *dfa {
+	res := new(dfa)
+	res.reset()
+	return res
+}
+
+func (self *dfa) reset() {
+	self.stale.Store(false)
+	self.ids = make(map[State]int)
+	self.states = make(map[string]*dfaState)
+	self.starts = make(map[startKey]*dfaEdge)
+}
+
+func cacheable(s State) bool {
+	switch s.(type) {
+	case *BasicState, *SpecialState, *csState, *capState, *assertState:
+		return true
+	}
+	return false
+}
+
+// Get the DFA state to begin matching from, given the rune before the
+// starting position and a way of getting the rune at it.
+func (self *dfa) start(root State, prev rune, peek func() rune) *dfaState {
+	if self.stale.Load() || len(self.states) > maxDfaStates {
+		self.reset()
+	}
+	key := startKey{root, class(prev)}
+	edge, ok := self.starts[key]
+	if ok {
+		if res, _, done := edge.get(peek); done {
+			return res
+		}
+	} else {
+		edge = new(dfaEdge)
+	}
+	ctx := &context{prev: prev, peek: peek}
+	res := self.state(close([]State{root}, ctx))
+	if res.cache {
+		edge.set(ctx, res)
+		self.starts[key] = edge
+	}
+	return res
+}
+
+// Follow a transition, returning nil if nothing can be matched. peek gets
+// the rune after c.
+func (self *dfa) step(from *dfaState, c rune, peek func() rune) *dfaState {
+	edge, ok := from.next[c]
+	if ok {
+		if res, _, done := edge.get(peek); done {
+			return res
+		}
+	} else {
+		edge = new(dfaEdge)
+	}
+	if len(self.states) > maxDfaStates {
+		// a long match can go through a lot of states without starting again,
+		// and from is the caller's, so it's still good after this
+		self.reset()
+	}
+	var res *dfaState
+	ctx := &context{prev: c, peek: peek}
+	if set := move(from.set, c); len(set) != 0 {
+		res = self.state(close(set, ctx))
+	}
+	if from.cache && (res == nil || res.cache) {
+		edge.set(ctx, res)
+		from.next[c] = edge
+	}
+	return res
+}
+
+// The state start would return, if it is already known. The DFA isn't
+// changed, so several goroutines can look at once.
+func (self *dfa) cachedStart(root State, prev rune, peek func() rune) (*dfaState, bool) {
+	if self.stale.Load() {
+		return nil, false
+	}
+	if edge, ok := self.starts[startKey{root, class(prev)}]; ok {
+		if res, _, done := edge.get(peek); done {
+			return res, true
+		}
+	}
+	return nil, false
+}
+
+// The state step would return, if it is already known, as for cachedStart.
+func (self *dfa) cachedStep(from *dfaState, c rune, peek func() rune) (*dfaState, bool) {
+	if edge, ok := from.next[c]; ok {
+		if res, _, done := edge.get(peek); done {
+			return res, true
+		}
+	}
+	return nil, false
+}
+
+func (self *dfa) state(set []State) *dfaState {
+	for _, x := range set {
+		if !cacheable(x) {
+			rule, final := finished(set)
+			return &dfaState{set, rule, final, false, nil}
+		}
+	}
+	key := self.key(set)
+	if res, ok := self.states[key]; ok {
+		return res
+	}
+	rule, final := finished(set)
+	res := &dfaState{set, rule, final, true, make(map[rune]*dfaEdge)}
+	self.states[key] = res
+	if !self.frozen {
+		for _, x := range set {
+			switch x := x.(type) {
+			case *BasicState:
+				x.watchers.watch(self)
+			case *SpecialState:
+				x.watchers.watch(self)
+			}
+		}
+	}
+	return res
+}
+
+func (self *dfa) key(set []State) string {
+	ids := make([]int, len(set))
+	for i, x := range set {
+		id, ok := self.ids[x]
+		if !ok {
+			id = len(self.ids)
+			self.ids[x] = id
+		}
+		ids[i] = id
+	}
+	sort.Ints(ids)
+	buf := make([]byte, 0, len(ids)*binary.MaxVarintLen32)
+	for _, x := range ids {
+		buf = binary.AppendUvarint(buf, uint64(x))
+	}
+	return string(buf)
+}
@@ -0,0 +1,202 @@
+package lexer
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+/* Drawing graphs */
+
+// Write out the state graph reachable from root in Graphviz's DOT language,
+// for looking at with dot -Tsvg or the like. Transitions are labelled with
+// the characters or charsets they take, and empty transitions are dashed.
+// Final states are drawn with double circles and labelled with their
+// identifiers.
+func WriteDot(w io.Writer, root State) error {
+	ids := make(map[State]int)
+	var states []State
+	walk(root, func(s State) {
+		ids[s] = len(states)
+		states = append(states, s)
+	})
+	var b strings.Builder
+	b.WriteString("digraph nfa {\n\trankdir=LR;\n\tnode [shape=circle];\n")
+	b.WriteString("\tstart [shape=point];\n\tstart -> 0;\n")
+	for i, s := range states {
+		switch s := s.(type) {
+		case *BasicState:
+			dotNode(&b, i, s.final, s.change, s.action != nil)
+			dotTransitions(&b, i, s.transitions, ids)
+			for _, x := range s.empty {
+				dotEmpty(&b, i, ids[x], "")
+			}
+		case *SpecialState:
+			dotNode(&b, i, FAIL, modeChange{}, false)
+			for _, x := range s.next {
+				dotEdge(&b, i, ids[x], "any")
+			}
+		case *csState:
+			dotNode(&b, i, FAIL, modeChange{}, false)
+			for _, x := range s.next {
+				dotEdge(&b, i, ids[x], setLabel(s.set))
+			}
+		case *capState:
+			dotNode(&b, i, FAIL, modeChange{}, false)
+			group := strconv.Itoa(s.group)
+			if s.name != "" {
+				group = s.name
+			}
+			label := "(" + group
+			if s.end {
+				label = group + ")"
+			}
+			for _, x := range s.next {
+				dotEmpty(&b, i, ids[x], label)
+			}
+		case *assertState:
+			dotNode(&b, i, FAIL, modeChange{}, false)
+			for _, x := range s.next {
+				dotEmpty(&b, i, ids[x], Anchor{s.kind}.String())
+			}
+		default:
+			// not one of ours, so there's no telling where it goes
+			fmt.Fprintf(&b, "\t%d [shape=box, label=%s];\n", i, dotQuote(fmt.Sprintf("%d\n%T", i, s)))
+		}
+	}
+	b.WriteString("}\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// Write out the DFA in the same manner as WriteDot. There is an arrow into
+// the starting state of each mode, labelled with the name of the mode.
+func (self *Table) WriteDot(w io.Writer) error {
+	var b strings.Builder
+	b.WriteString("digraph dfa {\n\trankdir=LR;\n\tnode [shape=circle];\n")
+	names := make([]string, 0, len(self.Modes))
+	for name := range self.Modes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		fmt.Fprintf(&b, "\tstart%d [shape=point];\n", i)
+		fmt.Fprintf(&b, "\tstart%d -> %d [label=%s];\n", i, self.Modes[name], dotQuote(name))
+	}
+	for i, s := range self.States {
+		dotNode(&b, i, s.Final, modeChange{s.Pop, s.Push, s.Mode}, false)
+		// one arrow for each state led to
+		sets := make(map[int][]runeRange)
+		var order []int
+		for _, t := range s.Trans {
+			if _, ok := sets[t.To]; !ok {
+				order = append(order, t.To)
+			}
+			sets[t.To] = append(sets[t.To], runeRange{t.Lo, t.Hi})
+		}
+		for _, to := range order {
+			dotEdge(&b, i, to, setLabel(makeSet(sets[to])))
+		}
+	}
+	b.WriteString("}\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func dotNode(b *strings.Builder, id, final int, change modeChange, action bool) {
+	if final == FAIL {
+		fmt.Fprintf(b, "\t%d;\n", id)
+		return
+	}
+	label := fmt.Sprintf("%d\nid %d", id, final)
+	if change.pop {
+		label += "\npop"
+	}
+	if change.push {
+		label += "\npush " + change.mode
+	}
+	if action {
+		label += "\naction"
+	}
+	fmt.Fprintf(b, "\t%d [shape=doublecircle, label=%s];\n", id, dotQuote(label))
+}
+
+// Transitions on single characters, gathered up by where they lead.
+func dotTransitions(b *strings.Builder, from int, trans map[rune]State, ids map[State]int) {
+	sets := make(map[int][]runeRange)
+	for c, x := range trans {
+		sets[ids[x]] = append(sets[ids[x]], runeRange{c, c})
+	}
+	to := make([]int, 0, len(sets))
+	for x := range sets {
+		to = append(to, x)
+	}
+	sort.Ints(to)
+	for _, x := range to {
+		dotEdge(b, from, x, setLabel(makeSet(sets[x])))
+	}
+}
+
+func dotEdge(b *strings.Builder, from, to int, label string) {
+	fmt.Fprintf(b, "\t%d -> %d [label=%s];\n", from, to, dotQuote(label))
+}
+
+func dotEmpty(b *strings.Builder, from, to int, label string) {
+	if label == "" {
+		label = "ε"
+	}
+	fmt.Fprintf(b, "\t%d -> %d [label=%s, style=dashed];\n", from, to, dotQuote(label))
+}
+
+// labels for charsets with more ranges than this are cut short
+const maxLabelRanges = 8
+
+func setLabel(set runeSet) string {
+	if len(set) == 1 && set[0].lo == set[0].hi {
+		return strconv.QuoteRune(set[0].lo)
+	}
+	c := Class{}
+	if inv := set.invert(); len(inv) < len(set) {
+		if len(inv) == 0 {
+			return "any"
+		}
+		c.Negate, set = true, inv
+	}
+	more := len(set) > maxLabelRanges
+	if more {
+		set = set[:maxLabelRanges]
+	}
+	for _, x := range set {
+		c.Ranges = append(c.Ranges, ClassRange{x.lo, x.hi})
+	}
+	res := c.String()
+	if more {
+		res = res[:len(res)-1] + "…]"
+	}
+	return res
+}
+
+// Quote a string for DOT, which only knows about \" and a few escapes of its
+// own in labels, such as \n.
+func dotQuote(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, c := range s {
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(c)
+		case c == '\n':
+			b.WriteString(`\n`)
+		case !unicode.IsPrint(c):
+			fmt.Fprintf(&b, `\\x{%x}`, c)
+		default:
+			b.WriteRune(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
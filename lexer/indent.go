@@ -0,0 +1,108 @@
+package lexer
+
+import (
+	"fmt"
+	"iter"
+	"slices"
+)
+
+/* Indentation */
+
+// An Indenter works out the structure of input whose indentation matters, as
+// in Python, from the tokens the Lexer finds in it. Where a token starts a
+// line, its column is the line's indentation. A line indented further than
+// the one before it begins with an INDENT token, and a line indented less
+// begins with one DEDENT token for each level it goes back out. Each line
+// ends with a NEWLINE token. None of these tokens have any text, and their
+// spans are empty: INDENT and DEDENT tokens lie at the start of the line's
+// first token, and NEWLINE tokens at the end of its last.
+//
+// Lines with no tokens on them (e.g. blank lines, or lines holding only
+// skipped comments) play no part. Neither do the line breaks inside brackets,
+// so a bracketed expression can carry on over several lines whatever their
+// indentation. Use SetTabWidth on the Scanner to have tabs counted properly.
+type Indenter struct {
+	// the identifiers to give to the tokens the Indenter makes
+	Indent, Dedent, Newline int
+	// the identifiers of the tokens that open and close brackets
+	Open, Close []int
+}
+
+// A line that goes back out to a column that none of the lines around it
+// were indented to, found at Loc.
+type IndentError struct {
+	Loc Location
+}
+
+func (self *IndentError) Error() string {
+	return fmt.Sprintf("inconsistent dedent at %s", self.Loc)
+}
+
+// The tokens from the Lexer, with INDENT, DEDENT and NEWLINE tokens added in.
+// At the end of the input, the last line is ended and every level of
+// indentation is closed. A line that doesn't line up with any of the levels
+// it goes back out past produces an *IndentError, which is the last thing
+// produced.
+func (self *Indenter) Tokens(tokens iter.Seq2[Token, error]) iter.Seq2[Token, error] {
+	return func(yield func(Token, error) bool) {
+		// the columns of the enclosing levels of indentation
+		levels := []int{1}
+		depth := 0
+		var last *Token
+		mark := func(id int, loc Location) bool {
+			return yield(Token{ID: id, Span: Span{loc, loc}}, nil)
+		}
+
+		for tok, err := range tokens {
+			if err != nil {
+				yield(Token{}, err)
+				return
+			}
+			if depth == 0 && (last == nil || tok.Span.Start.Line > last.Span.End.Line) {
+				if last != nil && !mark(self.Newline, last.Span.End) {
+					return
+				}
+				at := tok.Span.Start
+				if at.Col > levels[len(levels)-1] {
+					levels = append(levels, at.Col)
+					if !mark(self.Indent, at) {
+						return
+					}
+				}
+				for at.Col < levels[len(levels)-1] {
+					levels = levels[:len(levels)-1]
+					if at.Col > levels[len(levels)-1] {
+						yield(Token{}, &IndentError{at})
+						return
+					}
+					if !mark(self.Dedent, at) {
+						return
+					}
+				}
+			}
+			switch {
+			case slices.Contains(self.Open, tok.ID):
+				depth++
+			case slices.Contains(self.Close, tok.ID) && depth > 0:
+				depth--
+			}
+			if !yield(tok, nil) {
+				return
+			}
+			last = &tok
+		}
+
+		if last == nil {
+			return
+		}
+		if !mark(self.Newline, last.Span.End) {
+			return
+		}
+		for len(levels) > 1 {
+			levels = levels[:len(levels)-1]
+			if !mark(self.Dedent, last.Span.End) {
+				return
+			}
+		}
+	}
+}
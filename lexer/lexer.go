@@ -8,69 +8,74 @@ import (
 
 /* NFA operations */
 
-func contains(s State, ss []State) bool {
-	for _, x := range ss {
-		if s == x {
-			return true
-		}
-	}
-	return false
+// What surrounds a position in the input, as far as assertions are concerned.
+// The rune following the position is only looked at when it's needed.
+type context struct {
+	prev   rune
+	peek   func() rune
+	next   rune
+	peeked bool
 }
 
-func union(a []State, b []State) []State {
-	res := make([]State, len(a)+len(b))
-	l := copy(res, a)
-	for _, x := range b {
-		if !contains(x, res) {
-			res[l] = x
-			l++
-		}
+func (self *context) assert(a Assertion) bool {
+	if !self.peeked {
+		self.next = self.peek()
+		self.peeked = true
 	}
-	return res[0:l]
+	return a.Assert(self.prev, self.next)
 }
 
-func close(from []State) []State {
-	res := from
-	done := false
-	for !done {
-		done = true
-		for _, x := range res {
-			ss := x.Close()
-			if len(ss) != 0 {
-				newres := union(res, ss)
-				if len(newres) > len(res) {
-					res = newres
-					done = false
-				}
-			}
+// Follow the empty transitions out of some states. Without a context,
+// assertions are taken to hold.
+func close(from []State, ctx *context) []State {
+	res := make([]State, 0, len(from))
+	seen := make(map[State]bool)
+	var visit func(s State)
+	visit = func(s State) {
+		if seen[s] {
+			return
+		}
+		seen[s] = true
+		res = append(res, s)
+		if a, ok := s.(Assertion); ok && ctx != nil && !ctx.assert(a) {
+			return
 		}
+		for _, x := range s.Close() {
+			visit(x)
+		}
+	}
+	for _, x := range from {
+		visit(x)
 	}
 	return res
 }
 
 func move(from []State, c rune) []State {
 	to := []State{}
+	seen := make(map[State]bool)
 	for _, x := range from {
-		ss := x.Move(c)
-		if len(ss) != 0 {
-			to = union(to, ss)
+		for _, y := range x.Move(c) {
+			if !seen[y] {
+				seen[y] = true
+				to = append(to, y)
+			}
 		}
 	}
 	return to
 }
 
-type finishState struct {
-	id, pos int
-}
-
-func finished(set []State, pos int, fin []int) {
+// The final state in the set with the lowest identifier, along with that
+// identifier. If there are none, the identifier is FAIL.
+func finished(set []State) (State, int) {
+	var rule State
+	res := FAIL
 	for _, x := range set {
 		f := x.Final()
-		if f != FAIL && (pos > fin[1] || (pos == fin[1] && f < fin[0])) {
-			fin[0] = f
-			fin[1] = pos
+		if f != FAIL && (res == FAIL || f < res) {
+			rule, res = x, f
 		}
 	}
+	return rule, res
 }
 
 /* Main interface */
@@ -79,19 +84,45 @@ const (
 	_ = -iota
 	FAIL
 	EOF
+	ERROR
+	SKIP
 )
 
+// A Lexer holds a set of rules, along with a Scanner for matching them against
+// some input. The rules may be changed at any time, and take effect from the
+// next call to Next(). A Lexer cannot be used from more than one goroutine at
+// once: for that, see Spec.
 type Lexer struct {
-	root          *BasicState
+	root  *BasicState
+	modes map[string]*BasicState
+	spec  *Spec
+	Scanner
+}
+
+// A Scanner goes through some input, matching it against the rules in a Spec.
+// Each Scanner has its own place in its own input, and its own mode stack.
+type Scanner struct {
+	spec          *Spec
+	stack         *modeStack
 	src           *bufio.Reader
 	buf           []rune
+	sizes         []uint8
+	base          int
 	pos, startPos int
-	eof           bool
+	reach         int
+	loc, startLoc Location
+	tab           int
+	eof, recover  bool
+	err           error
+	value         any
 }
 
 func New() *Lexer {
 	res := new(Lexer)
 	res.root = NewState()
+	res.modes = map[string]*BasicState{"": res.root}
+	res.spec = &Spec{modes: res.modes, dfa: newDfa()}
+	res.Scanner = Scanner{spec: res.spec, tab: 1}
 	return res
 }
 
@@ -100,84 +131,244 @@ func (self *Lexer) Root() *BasicState {
 }
 
 func (self *Lexer) Start(src io.Reader) {
-	self.src = bufio.NewReader(src)
-	self.buf = make([]rune, 0)
-	self.pos = 0
+	self.Scanner.start(src)
 }
 
 func (self *Lexer) StartString(src string) {
 	self.Start(strings.NewReader(src))
 }
 
-func (self *Lexer) get(pos int) rune {
-	for pos >= len(self.buf) {
-		c, _, err := self.src.ReadRune()
+func (self *Scanner) start(src io.Reader) {
+	self.src = bufio.NewReader(src)
+	self.buf = make([]rune, 0)
+	self.sizes = make([]uint8, 0)
+	self.base = 0
+	self.pos = 0
+	self.loc, self.startLoc = startLocation, startLocation
+	self.eof = false
+	self.err = nil
+	self.stack = nil
+}
+
+func (self *Scanner) get(pos int) rune {
+	if pos >= self.reach {
+		self.reach = pos + 1
+	}
+	for pos-self.base >= len(self.buf) {
+		if self.src == nil {
+			return FAIL
+		}
+		c, n, err := self.src.ReadRune()
 		if err != nil {
 			if err == io.EOF {
 				self.eof = true
+			} else {
+				self.err = err
 			}
 			self.src = nil
 			return FAIL
 		}
 		self.buf = append(self.buf, c)
+		self.sizes = append(self.sizes, uint8(n))
 	}
-	return self.buf[pos]
+	return self.buf[pos-self.base]
 }
 
-func (self *Lexer) Next() int {
-	if self.eof {
+// The Lexer only holds on to the input from the current token onwards (plus
+// the rune before it, for assertions), so that memory use depends on the size
+// of the tokens rather than the size of the input. Once enough has been read
+// past, the buffer is copied down, leaving any slices returned by Data()
+// alone.
+const minDiscard = 4096
+
+func (self *Scanner) discard() {
+	n := self.pos - 1 - self.base
+	if n < minDiscard || n < len(self.buf)/2 {
+		return
+	}
+	self.buf = append(make([]rune, 0, 2*(len(self.buf)-n)), self.buf[n:]...)
+	self.sizes = append(make([]uint8, 0, cap(self.buf)), self.sizes[n:]...)
+	self.base += n
+}
+
+func (self *Scanner) Next() int {
+	self.reach = self.pos
+	for {
+		if id := self.next(); id != SKIP {
+			return id
+		}
+	}
+}
+
+func (self *Scanner) next() int {
+	if self.Eof() {
 		return EOF
 	}
-	if self.src == nil {
+	if self.src == nil && !self.eof {
 		return FAIL
 	}
-	fin := []int{FAIL, -1}
-	{
-		pos := self.pos
-		self.startPos = pos
-		this := []State{self.root}
-		for {
-			// follow the empty transitions
-			this = close(this)
-			// check for finish states
-			finished(this, pos, fin)
-			// try to move
-			c := self.get(pos)
-			if c == FAIL {
-				break
-			}
-			next := move(this, c)
-			if len(next) == 0 {
-				break
-			}
-			// consume a char
-			pos++
-			// proceed to the next state set
-			this = next
+	self.err, self.value = nil, nil
+	self.discard()
+	self.startPos, self.startLoc = self.pos, self.loc
+	rule, fin, end := self.match(self.pos)
+	if fin == FAIL && self.Eof() {
+		// there turned out to be nothing left
+		return EOF
+	}
+	if fin == FAIL {
+		return self.noMatch()
+	}
+	if s, ok := rule.(*BasicState); ok && s.trail != 0 {
+		end = self.trailEnd(s, self.startPos, end)
+	}
+	stack := self.stack
+	self.consume(end)
+	if s, ok := rule.(*BasicState); ok {
+		self.changeMode(s.change)
+		if s.action != nil {
+			fin = self.act(s.action, fin)
+		}
+	}
+	if fin != FAIL && self.pos == self.startPos && self.stack.equal(stack) {
+		// an empty match that leaves the mode alone would only be found
+		// again, so it counts for nothing
+		if self.Eof() {
+			return EOF
+		}
+		return self.noMatch()
+	}
+	return fin
+}
+
+// What happens when none of the rules match at the current position. With
+// SetRecover on, the input up to the next place a rule matches something is an
+// ERROR token.
+func (self *Scanner) noMatch() int {
+	if !self.recover || self.get(self.pos) == FAIL {
+		return FAIL
+	}
+	end := self.pos + 1
+	for self.get(end) != FAIL {
+		if _, f, e := self.match(end); f != FAIL && e > end {
+			break
 		}
+		end++
 	}
-	if fin[0] != FAIL {
-		self.pos = fin[1]
+	self.consume(end)
+	return ERROR
+}
+
+// Move on to end, past the current token.
+func (self *Scanner) consume(end int) {
+	from, to := self.startPos-self.base, end-self.base
+	self.pos = end
+	self.loc = advance(self.loc, self.buf[from:to], self.sizes[from:to], self.tab)
+}
+
+// Find the longest match starting at pos, in the current mode. Returns the
+// final state matched, its identifier and where the match ends.
+func (self *Scanner) match(pos int) (State, int, int) {
+	if self.spec.table != nil {
+		return self.matchTable(pos)
+	}
+	var rule State
+	fin, end := FAIL, -1
+	prev := rune(FAIL)
+	if pos > 0 {
+		prev = self.buf[pos-1-self.base]
 	}
-	return fin[0]
+	peek := func() rune {
+		return self.get(pos + 1)
+	}
+	this := self.spec.start(self.spec.root(self.CurrentMode()), prev, func() rune {
+		return self.get(pos)
+	})
+	for {
+		// check for finish states
+		if this.final != FAIL {
+			rule, fin, end = this.rule, this.final, pos
+		}
+		// try to move
+		c := self.get(pos)
+		if c == FAIL {
+			break
+		}
+		this = self.spec.step(this, c, peek)
+		if this == nil {
+			break
+		}
+		// consume a char
+		pos++
+	}
+	return rule, fin, end
+}
+
+// Where a match of a rule with trailing context ends, once the context has
+// been given back.
+func (self *Scanner) trailEnd(rule *BasicState, start, end int) int {
+	if rule.trail != FAIL {
+		return end - rule.trail
+	}
+	root := self.spec.root(self.CurrentMode())
+	return contextEnd(root, rule, self.buf, start-self.base, end-self.base) + self.base
+}
+
+// The same as match, using the Spec's table.
+func (self *Scanner) matchTable(pos int) (State, int, int) {
+	var rule State
+	fin, end := FAIL, -1
+	t := self.spec.table
+	this, ok := t.Modes[self.CurrentMode()]
+	if !ok {
+		return nil, FAIL, -1
+	}
+	for {
+		if f := t.States[this].Final; f != FAIL {
+			rule, fin, end = t.rules[this], f, pos
+		}
+		c := self.get(pos)
+		if c == FAIL {
+			break
+		}
+		this = t.step(this, c)
+		if this == FAIL {
+			break
+		}
+		pos++
+	}
+	return rule, fin, end
+}
+
+// Have the Lexer carry on past input that none of the rules match. Instead of
+// returning FAIL, Next() returns ERROR, with String() and Span() covering the
+// input up to the next place a rule matches.
+func (self *Scanner) SetRecover(on bool) {
+	self.recover = on
+}
+
+// Why Next() last returned FAIL, when it wasn't just that the input didn't
+// match: an error from reading the input, or from an action.
+func (self *Scanner) Err() error {
+	return self.err
 }
 
-func (self *Lexer) Eof() bool {
-	return self.eof
+// Whether the input has been used up.
+func (self *Scanner) Eof() bool {
+	return self.eof && self.pos >= self.base+len(self.buf)
 }
 
-func (self *Lexer) Pos() int {
+func (self *Scanner) Pos() int {
 	return self.startPos
 }
 
-func (self *Lexer) Len() int {
+func (self *Scanner) Len() int {
 	return self.pos - self.startPos
 }
 
-func (self *Lexer) Data() []rune {
-	return self.buf[self.startPos:self.pos]
+func (self *Scanner) Data() []rune {
+	return self.buf[self.startPos-self.base : self.pos-self.base]
 }
 
-func (self *Lexer) String() string {
+func (self *Scanner) String() string {
 	return string(self.Data())
 }
@@ -0,0 +1,488 @@
+package lexer
+
+import (
+	"math/rand"
+	"reflect"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+	"testing"
+)
+
+func loadSpec(t *testing.T, spec string) (*Lexer, *Names) {
+	t.Helper()
+	l, names, err := LoadSpec(strings.NewReader(spec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l, names
+}
+
+func texts(toks []Token) []string {
+	res := make([]string, len(toks))
+	for i, tok := range toks {
+		res[i] = tok.Text
+	}
+	return res
+}
+
+func TestSpecUnicodeClass(t *testing.T) {
+	l, names := loadSpec(t, `
+LETTER = \p{L}
+WORD   {LETTER}+|\p{Greek}\P{L}
+SPACE  [ ]+  -> skip
+`)
+	toks, err := l.Tokenize("héllo Ω1 wörld")
+	if err != nil {
+		t.Fatal(err)
+	}
+	word, _ := names.ID("WORD")
+	want := []string{"héllo", "Ω1", "wörld"}
+	if got := texts(toks); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	for _, tok := range toks {
+		if tok.ID != word {
+			t.Fatalf("%v is not a WORD", tok)
+		}
+	}
+}
+
+// A random expression, built up from pieces that exercise the DFA. It never
+// matches the empty string.
+func randomRegex(rng *rand.Rand) string {
+	atoms := []string{"a", "b", "c", "é", ".", "[ab]", "[^a]", "[a-c]+", "b*", "(a|bc)", "(ab)?", "a{2,3}", `\s`}
+	var b strings.Builder
+	for n := 1 + rng.Intn(4); n > 0; n-- {
+		b.WriteString(atoms[rng.Intn(len(atoms))])
+	}
+	b.WriteString("[abc é\n]")
+	return b.String()
+}
+
+func randomInput(rng *rand.Rand, n int) string {
+	alpha := []rune("abcé \n")
+	rs := make([]rune, rng.Intn(n))
+	for i := range rs {
+		rs[i] = alpha[rng.Intn(len(alpha))]
+	}
+	return string(rs)
+}
+
+// Rules with modes: the last rule in the default mode enters another mode,
+// where a newline leaves it again.
+func randomLexer(rng *rand.Rand) (*Lexer, []string) {
+	l := New()
+	var res []string
+	for id := 0; id < 1+rng.Intn(5); id++ {
+		re := randomRegex(rng)
+		res = append(res, re)
+		l.ForceRegex(re, nil).SetFinal(id)
+	}
+	push := l.ForceRegex("é", nil)
+	push.SetFinal(10)
+	push.PushMode("m")
+	end, _ := l.Mode("m").AddRegex(`\n`, nil)
+	end.SetFinal(11)
+	end.PopMode()
+	m, _ := l.Mode("m").AddRegex(randomRegex(rng), nil)
+	m.SetFinal(12)
+	return l, res
+}
+
+func TestTableMatchesDFA(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for round := 0; round < 300; round++ {
+		l, rules := randomLexer(rng)
+		spec := l.Spec()
+		if spec.table == nil {
+			t.Fatalf("%q: no table", rules)
+		}
+		l.SetRecover(true)
+		for n := 0; n < 20; n++ {
+			in := randomInput(rng, 12)
+			want, err := l.Tokenize(in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := spec.ScanString(in)
+			s.SetRecover(true)
+			got, err := collect(s.Tokens())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("%q on %q:\ntable: %v\nDFA:   %v", rules, in, got, want)
+			}
+		}
+	}
+}
+
+// Words and nested comments, with assertions to look at the runes around the
+// edit.
+const commentSpec = `
+AB       \bab+\b
+WORD     [a-z]+
+X        a*c*x
+SPACE    [ \t\n]+    -> skip
+OPEN     \/\*        -> push comment
+
+%mode comment
+OPEN     \/\*        -> push comment
+CLOSE    \*\/        -> pop
+TEXT     [^*/]+|.
+`
+
+func TestModeStack(t *testing.T) {
+	l, names := loadSpec(t, commentSpec)
+	toks, err := l.Tokenize("ab /* x /* y */ z */ w")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, tok := range toks {
+		got = append(got, names.Name(tok.ID))
+	}
+	want := "AB OPEN TEXT OPEN TEXT CLOSE TEXT CLOSE WORD"
+	if strings.Join(got, " ") != want {
+		t.Fatalf("got %v, want %s", got, want)
+	}
+	l.StartString("/* /* */")
+	for l.Next() >= 0 {
+	}
+	if modes := l.Modes(); len(modes) != 2 || modes[1] != "comment" {
+		t.Fatalf("modes: %q", modes)
+	}
+}
+
+func TestRelexMatchesTokenize(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	alpha := []rune("abcx \t\n/*é")
+	random := func(n int) string {
+		rs := make([]rune, n)
+		for i := range rs {
+			rs[i] = alpha[rng.Intn(len(alpha))]
+		}
+		return string(rs)
+	}
+	for _, tab := range []int{1, 4} {
+		l, _ := loadSpec(t, commentSpec)
+		l.SetRecover(true)
+		l.SetTabWidth(tab)
+		for n := 0; n < 2000; n++ {
+			text := random(rng.Intn(40))
+			old, err := l.Tokenize(text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rs := []rune(text)
+			e := Edit{Pos: rng.Intn(len(rs) + 1), Inserted: random(rng.Intn(5))}
+			e.Deleted = rng.Intn(len(rs) - e.Pos + 1)
+			now := string(rs[:e.Pos]) + e.Inserted + string(rs[e.Pos+e.Deleted:])
+			want, err := l.Tokenize(now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, ch, err := l.Relex(old, now, e)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("%q -> %q:\nrelexed: %v\nwant:    %v", text, now, got, want)
+			}
+			// the tokens outside the change are the old ones
+			if !reflect.DeepEqual(texts(got[:ch.Start]), texts(old[:ch.Start])) ||
+				!reflect.DeepEqual(texts(got[ch.NewEnd:]), texts(old[ch.OldEnd:])) {
+				t.Fatalf("%q -> %q: %+v\nold: %v\nnew: %v", text, now, ch, old, got)
+			}
+		}
+	}
+}
+
+func TestRelexKeepsTokens(t *testing.T) {
+	l, _ := loadSpec(t, commentSpec)
+	text := strings.Repeat("abc x ", 200)
+	old, err := l.Tokenize(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ch, err := l.Relex(old, "q"+text[1:], Edit{0, 1, "q"})
+	if err != nil || len(got) != len(old) || ch.OldEnd > 2 {
+		t.Fatal(ch, err)
+	}
+}
+
+func TestTrailingContext(t *testing.T) {
+	for _, c := range []struct {
+		spec, in, want string
+		table          bool
+	}{
+		// context that is always the same length
+		{`
+NUMBER  [0-9]+(\.[0-9]+)?
+RANGE   [0-9]+/\.\.
+DOTS    \.\.
+SPACE   [ ]+  -> skip
+`, "1..2 3.5", "RANGE:1 DOTS:.. NUMBER:2 NUMBER:3.5", true},
+		// context that varies, which has to be found again after matching
+		{`
+KEY     [a-z]+/[ ]*=
+WORD    [a-z]+
+EQ      =
+SPACE   [ ]+  -> skip
+`, "ab  = cd ef=", "KEY:ab EQ:= WORD:cd KEY:ef EQ:=", false},
+	} {
+		l, names := loadSpec(t, c.spec)
+		spec := l.Spec()
+		if (spec.table != nil) != c.table {
+			t.Errorf("%q: table is %v", c.spec, spec.table)
+		}
+		for _, toks := range [][]Token{mustTokenize(t, l, c.in), mustTokenize(t, spec, c.in)} {
+			var got []string
+			for _, tok := range toks {
+				got = append(got, names.Name(tok.ID)+":"+tok.Text)
+			}
+			if strings.Join(got, " ") != c.want {
+				t.Errorf("%q: got %q, want %q", c.in, got, c.want)
+			}
+		}
+	}
+	for _, re := range []string{"a/", "/a", "(a/b)", "a/b/c"} {
+		if _, err := ParseRule(re, nil); err == nil {
+			t.Errorf("%q parsed", re)
+		}
+	}
+	// elsewhere, a / is just a /
+	if got := Matches("[0-9]+/x", "12x 34/x"); len(got) != 1 || got[0] != "34/x" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func mustTokenize(t *testing.T, l interface{ Tokenize(string) ([]Token, error) }, in string) []Token {
+	t.Helper()
+	toks, err := l.Tokenize(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return toks
+}
+
+func TestEmptyMatch(t *testing.T) {
+	l := New()
+	l.ForceRegex("[0-9]*", nil).SetFinal(0)
+	l.ForceRegex("[a-z]", nil).SetFinal(1)
+	toks, err := l.Tokenize("1!")
+	if _, ok := err.(*MatchError); !ok || len(toks) != 1 {
+		t.Fatal(toks, err)
+	}
+	if toks, err := l.Tokenize("a1b"); err != nil || len(toks) != 3 {
+		t.Fatal(toks, err)
+	}
+	l.SetRecover(true)
+	toks, err = l.Tokenize("1!!a")
+	if err != nil || strings.Join(texts(toks), " ") != "1 !! a" || toks[1].ID != ERROR {
+		t.Fatal(toks, err)
+	}
+
+	// the same goes for skipped matches
+	l, _ = loadSpec(t, "WORD [a-z]+\nSPACE [ ]* -> skip")
+	if toks, err := l.Tokenize("ab 1"); err == nil || len(toks) != 1 {
+		t.Fatal(toks, err)
+	}
+}
+
+func TestNestedRepeatError(t *testing.T) {
+	_, err := New().Regex("x(a{100}){100}", nil)
+	re, ok := err.(*RegexError)
+	if !ok || re.Expr != "x(a{100}){100}" || re.Pos != 9 {
+		t.Fatal(err)
+	}
+	if _, err := New().Regex("(a{10}){100}", nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// An expression with assertions and counted repeats in it, which the standard
+// regexp package understands in the same way. The class put in somewhere
+// stops it from matching the empty string, as empty matches are skipped here
+// but not there.
+func randomAssertRegex(rng *rand.Rand) string {
+	atoms := []string{"a", "b", "ab", "[ab]", `\b`, `\B`, "(?m:^)", "$", `\s`, "(a|b)", "(ab)?", "(a|ab)*", "a{1,2}", "(b|ab){0,2}", "[a-c]{2}", "x*"}
+	var parts []string
+	for n := rng.Intn(5); n > 0; n-- {
+		parts = append(parts, atoms[rng.Intn(len(atoms))])
+	}
+	i := rng.Intn(len(parts) + 1)
+	parts = append(parts[:i], append([]string{"[abx]"}, parts[i:]...)...)
+	return strings.Join(parts, "")
+}
+
+func TestRegexMatchesStdlib(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	alpha := []rune("abx _\n")
+	for round := 0; round < 2000; round++ {
+		re := randomAssertRegex(rng)
+		rs := make([]rune, rng.Intn(12))
+		for i := range rs {
+			rs[i] = alpha[rng.Intn(len(alpha))]
+		}
+		in := string(rs)
+		for _, first := range []bool{false, true} {
+			std := regexp.MustCompile(re)
+			if !first {
+				std.Longest()
+			}
+			r := NewRegex(re, nil)
+			r.SetFirst(first)
+			want := std.FindAllStringSubmatchIndex(in, -1)
+			if got := r.FindAllSubmatchIndex(in, -1); !reflect.DeepEqual(got, want) {
+				t.Fatalf("%s on %q (first: %v):\ngot  %v\nwant %v", re, in, first, got, want)
+			}
+		}
+	}
+}
+
+func TestReplaceTemplate(t *testing.T) {
+	for _, c := range []struct {
+		re, in, template, want string
+	}{
+		{`(\w+)=(\w+)`, "a=1 b=2", "$2=$1", "1=a 2=b"},
+		// a name goes on for as long as it can
+		{`(\w+)=(\w+)`, "a=1", "$1x", ""},
+		{`(\w+)=(\w+)`, "a=1", "${1}x", "ax"},
+		{`(?P<key>\w+)=(?P<val>\w+)`, "a=1", "${val}:$key", "1:a"},
+		{`(\w+)`, "ab", "$$1 costs $$$1", "$1 costs $ab"},
+		// groups that aren't there, or didn't match, are left out
+		{`(a)|(b)`, "ab", "[$1$2$3$nope]", "[a][b]"},
+		// a $ that isn't a reference stands for itself
+		{`a`, "a", "$ ${ ${x $-", "$ ${ ${x $-"},
+	} {
+		if got := NewRegex(c.re, nil).ReplaceTemplate(c.in, c.template); got != c.want {
+			t.Errorf("%s on %q with %q: got %q, want %q", c.re, c.in, c.template, got, c.want)
+		}
+	}
+}
+
+func TestRegexOffsets(t *testing.T) {
+	for _, c := range []struct {
+		re, in    string
+		runes     []int
+		bytes     []int
+		split     []string
+		replaced  string
+		line, col int
+	}{
+		{`b+`, "aébb", []int{2, 4}, []int{3, 5}, []string{"aé", ""}, "aé<bb>", 1, 3},
+		{`é`, "日本é語", []int{2, 3}, []int{6, 8}, []string{"日本", "語"}, "日本<é>語", 1, 3},
+		{`x`, "é\néx", []int{3, 4}, []int{5, 6}, []string{"é\né", ""}, "é\né<x>", 2, 2},
+	} {
+		r := NewRegex(c.re, nil)
+		sp, ok := r.FindSpan(c.in)
+		if !ok || sp.Start.Pos != c.runes[0] || sp.End.Pos != c.runes[1] ||
+			sp.Start.Offset != c.bytes[0] || sp.End.Offset != c.bytes[1] ||
+			sp.Start.Line != c.line || sp.Start.Col != c.col {
+			t.Errorf("%s on %q: span %+v", c.re, c.in, sp)
+		}
+		if got := r.FindIndex(c.in); !reflect.DeepEqual(got, c.bytes) {
+			t.Errorf("%s on %q: index %v, want %v", c.re, c.in, got, c.bytes)
+		}
+		if got := r.Split(c.in, -1); !reflect.DeepEqual(got, c.split) {
+			t.Errorf("%s on %q: split %q, want %q", c.re, c.in, got, c.split)
+		}
+		if got := r.ReplaceTemplate(c.in, "<$0>"); got != c.replaced {
+			t.Errorf("%s on %q: replaced %q, want %q", c.re, c.in, got, c.replaced)
+		}
+	}
+}
+
+func TestAnalyse(t *testing.T) {
+	l, names := loadSpec(t, "WORD [a-z]+\nIF if\nNUMBER [0-9]+\nSPACE [ ]+ -> skip")
+	a, err := l.Analyse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	word, _ := names.ID("WORD")
+	kw, _ := names.ID("IF")
+	if !reflect.DeepEqual(a.Unreachable, []Rule{{"", kw}}) {
+		t.Errorf("unreachable: %v", a.Unreachable)
+	}
+	if !reflect.DeepEqual(a.Overlaps, []Overlap{{"", word, kw, "if"}}) {
+		t.Errorf("overlaps: %v", a.Overlaps)
+	}
+
+	// the other way round, both can match
+	l, _ = loadSpec(t, "IF if\nWORD [a-z]+")
+	a, err = l.Analyse()
+	if err != nil || len(a.Unreachable) != 0 || len(a.Overlaps) != 1 || a.Overlaps[0].Example != "if" {
+		t.Fatal(a, err)
+	}
+}
+
+func TestFromSyntax(t *testing.T) {
+	for _, c := range []struct {
+		re, in string
+		want   []string
+	}{
+		{`(?i)if`, "if IF iF xif", []string{"if", "IF", "iF", "if"}},
+		{`(?i:k)`, "kKK", []string{"k", "K", "K"}},
+		{`a.b`, "a\nb axb", []string{"axb"}},
+		{`(?s)a.b`, "a\nb", []string{"a\nb"}},
+		{`<.+?>`, "<a><b>", []string{"<a>", "<b>"}},
+		{`a{2,3}?`, "aaaaa", []string{"aa", "aa"}},
+	} {
+		re, err := syntax.Parse(c.re, syntax.Perl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l := New()
+		end, err := l.Root().AddSyntax(re)
+		if err != nil {
+			t.Fatal(err)
+		}
+		end.SetFinal(0)
+		r := &Regex{l, []string{""}, true}
+		if got := r.Matches(c.in); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s on %q: got %q, want %q", c.re, c.in, got, c.want)
+		}
+	}
+}
+
+func TestIndenter(t *testing.T) {
+	l, names := loadSpec(t, `
+WORD    [a-z]+
+OPEN    \(
+CLOSE   \)
+SPACE   [ \n]+  -> skip
+`)
+	lpar, _ := names.ID("OPEN")
+	rpar, _ := names.ID("CLOSE")
+	ind := &Indenter{100, 101, 102, []int{lpar}, []int{rpar}}
+	marks := map[int]string{100: "INDENT", 101: "DEDENT", 102: "NEWLINE"}
+	run := func(in string) (string, error) {
+		l.StartString(in)
+		var res []string
+		for tok, err := range ind.Tokens(l.Tokens()) {
+			if err != nil {
+				return strings.Join(res, " "), err
+			}
+			if m, ok := marks[tok.ID]; ok {
+				res = append(res, m)
+			} else {
+				res = append(res, tok.Text)
+			}
+		}
+		return strings.Join(res, " "), nil
+	}
+
+	got, err := run("a\n  b\n    c\n\n  d (e\nf\n      g) h\ni\n  j")
+	want := "a NEWLINE INDENT b NEWLINE INDENT c NEWLINE DEDENT d ( e f g ) h NEWLINE DEDENT i NEWLINE INDENT j NEWLINE DEDENT"
+	if err != nil || got != want {
+		t.Errorf("got %s, want %s (%v)", got, want, err)
+	}
+
+	got, err = run("a\n    b\n  c\nd")
+	ie, ok := err.(*IndentError)
+	if !ok || ie.Loc.Line != 3 || ie.Loc.Col != 3 || got != "a NEWLINE INDENT b NEWLINE" {
+		t.Errorf("got %s (%v)", got, err)
+	}
+}
@@ -0,0 +1,275 @@
+package lexer
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+)
+
+/* Spec files */
+
+// A spec file sets out a Lexer's rules as text, one to a line. Blank lines,
+// and lines beginning with #, are skipped.
+//
+//	# macros, for use in the rules below
+//	DIGIT  = [0-9]
+//	IDENT  = [\p{L}_][\p{L}\p{Nd}_]*
+//
+//	NUMBER   {DIGIT}+(\.{DIGIT}+)?
+//	NAME     {IDENT}
+//	SPACE    [ \t\n]+         -> skip
+//	COMMENT  \/\*             -> skip, push comment
+//
+//	%mode comment
+//	COMMENT  \*\/             -> skip, pop
+//	COMMENT  [^*]+|\*         -> skip
+//
+// A rule is the name of the token followed by the expression that matches it,
+// and optionally an arrow and what happens when it matches: skip, push MODE or
+// pop. A macro is a name, an equals sign and an expression, and {NAME} stands
+// for the expression in anything that follows (other than in charsets).
+// Leading and trailing spaces are not part of an expression. Expressions are
+// read as by ParseRule, so a / has to be escaped unless it starts trailing
+// context.
+//
+// Rules belong to the default mode, until a %mode line starts the rules for
+// another (a %mode line on its own goes back to the default mode). Tokens are
+// numbered from 0 in the order their names first appear, which also decides
+// which rule wins when two match the same input: after "A x" and "B a", a
+// later "A a" beats the "B a" above it. A name may have rules in more than one
+// mode, but it must either be skipped in all of them or in none.
+
+// The names of the tokens in a spec file, and the identifiers they were given.
+type Names struct {
+	names []string
+	ids   map[string]int
+	skip  []bool
+}
+
+// The identifier of a token, and whether there is such a token.
+func (self *Names) ID(name string) (int, bool) {
+	id, ok := self.ids[name]
+	return id, ok
+}
+
+// The name of a token. The identifiers the Lexer uses for itself (EOF and so
+// on) have names too.
+func (self *Names) Name(id int) string {
+	switch {
+	case id >= 0 && id < len(self.names):
+		return self.names[id]
+	case id == FAIL:
+		return "FAIL"
+	case id == EOF:
+		return "EOF"
+	case id == ERROR:
+		return "ERROR"
+	case id == SKIP:
+		return "SKIP"
+	}
+	return fmt.Sprint(id)
+}
+
+// How many tokens there are. Their identifiers run from 0 to one less than
+// this.
+func (self *Names) Len() int {
+	return len(self.names)
+}
+
+// Whether the rules for a token skip what they match.
+func (self *Names) Skipped(id int) bool {
+	return id >= 0 && id < len(self.skip) && self.skip[id]
+}
+
+// Something wrong on a line of a spec file.
+type SpecError struct {
+	Line int
+	Err  error
+}
+
+func (self *SpecError) Error() string {
+	return fmt.Sprintf("line %d: %s", self.Line, self.Err)
+}
+
+func (self *SpecError) Unwrap() error {
+	return self.Err
+}
+
+// Read a spec file, and build a Lexer from it.
+func LoadSpec(r io.Reader) (*Lexer, *Names, error) {
+	l := New()
+	names := &Names{ids: make(map[string]int)}
+	macros := make(map[string]string)
+	modes := map[string]bool{"": true}
+	// where each mode was first pushed, for the error if it never turns up
+	pushed := make(map[string]int)
+	mode := ""
+
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		fail := func(format string, args ...any) (*Lexer, *Names, error) {
+			return nil, nil, &SpecError{line, fmt.Errorf(format, args...)}
+		}
+		text := strings.TrimSpace(s.Text())
+		if text == "" || text[0] == '#' {
+			continue
+		}
+		if text[0] == '%' {
+			fields := strings.Fields(text)
+			if fields[0] != "%mode" || len(fields) > 2 {
+				return fail("unknown directive %q", text)
+			}
+			mode = ""
+			if len(fields) == 2 {
+				mode = fields[1]
+			}
+			modes[mode] = true
+			continue
+		}
+
+		split := strings.IndexFunc(text, unicode.IsSpace)
+		if split == -1 {
+			return fail("missing expression")
+		}
+		name, rest := text[:split], strings.TrimSpace(text[split:])
+		if !isIdent(name) {
+			return fail("invalid name %q", name)
+		}
+
+		// macros
+		if len(rest) > 1 && rest[0] == '=' && unicode.IsSpace(rune(rest[1])) {
+			if _, ok := macros[name]; ok {
+				return fail("macro %s already defined", name)
+			}
+			re, err := expandMacros(strings.TrimSpace(rest[1:]), macros)
+			if err != nil {
+				return fail("%s", err)
+			}
+			n, err := ParseRule(re, nil)
+			if err != nil {
+				return fail("%s", err)
+			}
+			if _, ok := n.(Trailing); ok {
+				return fail("macros cannot have trailing context")
+			}
+			macros[name] = re
+			continue
+		}
+
+		// rules
+		re, actions := rest, []string{}
+		if i := strings.LastIndex(rest, "->"); i > 0 && unicode.IsSpace(rune(rest[i-1])) {
+			re, actions = strings.TrimSpace(rest[:i]), strings.Split(rest[i+2:], ",")
+		}
+		re, err := expandMacros(re, macros)
+		if err != nil {
+			return fail("%s", err)
+		}
+		end, err := l.Mode(mode).AddRule(re, nil)
+		if err != nil {
+			return fail("%s", err)
+		}
+		id, ok := names.ids[name]
+		if !ok {
+			id = len(names.names)
+			names.ids[name] = id
+			names.names = append(names.names, name)
+		}
+		end.SetFinal(id)
+		skip := false
+		for _, a := range actions {
+			switch fields := strings.Fields(a); {
+			case len(fields) == 0:
+				return fail("missing action")
+			case len(fields) == 1 && fields[0] == "skip":
+				end.SetAction(Skip)
+				skip = true
+			case len(fields) == 1 && fields[0] == "pop":
+				end.PopMode()
+			case len(fields) == 2 && fields[0] == "push":
+				end.PushMode(fields[1])
+				if _, ok := pushed[fields[1]]; !ok {
+					pushed[fields[1]] = line
+				}
+			default:
+				return fail("unknown action %q", strings.TrimSpace(a))
+			}
+		}
+		if !ok {
+			names.skip = append(names.skip, skip)
+		} else if names.skip[id] != skip {
+			return fail("%s is skipped in some places but not others", name)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, nil, err
+	}
+	var missing error
+	first := 0
+	for mode, line := range pushed {
+		if !modes[mode] && (missing == nil || line < first) {
+			missing = &SpecError{line, fmt.Errorf("mode %s is not defined", mode)}
+			first = line
+		}
+	}
+	if missing != nil {
+		return nil, nil, missing
+	}
+	return l, names, nil
+}
+
+// Put the expressions of macros in place of their names. Braces holding
+// anything other than a name are left for the parser, as are those in
+// charsets and Unicode classes (\p{Greek}).
+func expandMacros(re string, macros map[string]string) (string, error) {
+	var res strings.Builder
+	depth := 0
+	for i := 0; i < len(re); i++ {
+		switch c := re[i]; {
+		case c == '\\' && i+2 < len(re) && (re[i+1] == 'p' || re[i+1] == 'P') && re[i+2] == '{':
+			// a Unicode class, whose name isn't a macro
+			end := strings.IndexByte(re[i:], '}')
+			if end == -1 {
+				end = len(re) - i - 1
+			}
+			res.WriteString(re[i : i+end+1])
+			i += end
+			continue
+		case c == '\\' && i+1 < len(re):
+			res.WriteString(re[i : i+2])
+			i++
+			continue
+		case c == '[':
+			depth++
+		case c == ']' && depth > 0:
+			depth--
+		case c == '{' && depth == 0:
+			end := strings.IndexByte(re[i:], '}')
+			if end == -1 || !isIdent(re[i+1:i+end]) {
+				break
+			}
+			name := re[i+1 : i+end]
+			body, ok := macros[name]
+			if !ok {
+				return "", errors.New("undefined macro " + name)
+			}
+			res.WriteString("(?:" + body + ")")
+			i += end
+			continue
+		}
+		res.WriteByte(re[i])
+	}
+	return res.String(), nil
+}
+
+func isIdent(s string) bool {
+	for i, c := range s {
+		if !(c == '_' || unicode.IsLetter(c) || i > 0 && unicode.IsDigit(c)) {
+			return false
+		}
+	}
+	return s != ""
+}
@@ -0,0 +1,79 @@
+package lexer
+
+/* Modes */
+
+// A Lexer may be in one of a number of modes, each of which has its own set
+// of rules, in the manner of flex's start conditions. The modes form a stack:
+// rules may enter a new mode when they match (with PushMode), or return to the
+// mode that was current beforehand (with PopMode). The default mode, named "",
+// is always at the bottom of the stack and has Root() as its rules.
+
+// The state that the rules for a mode hang off, creating it if need be.
+func (self *Lexer) Mode(name string) *BasicState {
+	res, ok := self.modes[name]
+	if !ok {
+		res = NewState()
+		self.modes[name] = res
+	}
+	return res
+}
+
+// The mode stack is never changed in place, only replaced, so that tokens can
+// hold on to it as it was when they were matched. The default mode lies below
+// the bottom, so nil stands for a stack with only the default mode on it.
+type modeStack struct {
+	mode  string
+	below *modeStack
+}
+
+func (self *modeStack) equal(other *modeStack) bool {
+	for self != other {
+		if self == nil || other == nil || self.mode != other.mode {
+			return false
+		}
+		self, other = self.below, other.below
+	}
+	return true
+}
+
+// The name of the mode the Lexer is in.
+func (self *Scanner) CurrentMode() string {
+	if self.stack == nil {
+		return ""
+	}
+	return self.stack.mode
+}
+
+// The names of the modes on the stack, with the current mode last.
+func (self *Scanner) Modes() []string {
+	res := []string{}
+	for s := self.stack; s != nil; s = s.below {
+		res = append(res, s.mode)
+	}
+	res = append(res, "")
+	for i, j := 0, len(res)-1; i < j; i, j = i+1, j-1 {
+		res[i], res[j] = res[j], res[i]
+	}
+	return res
+}
+
+// Enter a mode.
+func (self *Scanner) PushMode(name string) {
+	self.stack = &modeStack{name, self.stack}
+}
+
+// Go back to the previous mode. The default mode is never left.
+func (self *Scanner) PopMode() {
+	if self.stack != nil {
+		self.stack = self.stack.below
+	}
+}
+
+func (self *Scanner) changeMode(c modeChange) {
+	if c.pop {
+		self.PopMode()
+	}
+	if c.push {
+		self.PushMode(c.mode)
+	}
+}
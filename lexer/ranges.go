@@ -0,0 +1,144 @@
+package lexer
+
+import (
+	"sort"
+	"sync"
+	"unicode"
+)
+
+/* Sets of runes */
+
+// A set of runes, held as a list of ranges. The ranges are kept in order and
+// neither overlap nor touch.
+type runeSet []runeRange
+
+type runeRange struct {
+	lo, hi rune
+}
+
+var anyRune = runeSet{{0, unicode.MaxRune}}
+
+// Put some ranges into order, merging them where they overlap or touch.
+func makeSet(rs []runeRange) runeSet {
+	sort.Slice(rs, func(i, j int) bool {
+		return rs[i].lo < rs[j].lo
+	})
+	res := runeSet{}
+	for _, x := range rs {
+		if l := len(res); l > 0 && x.lo <= res[l-1].hi+1 {
+			if x.hi > res[l-1].hi {
+				res[l-1].hi = x.hi
+			}
+			continue
+		}
+		res = append(res, x)
+	}
+	return res
+}
+
+func (self runeSet) has(c rune) bool {
+	i := sort.Search(len(self), func(i int) bool {
+		return self[i].hi >= c
+	})
+	return i < len(self) && self[i].lo <= c
+}
+
+func (self runeSet) union(other runeSet) runeSet {
+	rs := make([]runeRange, 0, len(self)+len(other))
+	rs = append(append(rs, self...), other...)
+	return makeSet(rs)
+}
+
+// The runes in both sets.
+func (self runeSet) intersect(other runeSet) runeSet {
+	res := runeSet{}
+	for i, j := 0, 0; i < len(self) && j < len(other); {
+		a, b := self[i], other[j]
+		lo, hi := max(a.lo, b.lo), min(a.hi, b.hi)
+		if lo <= hi {
+			res = append(res, runeRange{lo, hi})
+		}
+		if a.hi < b.hi {
+			i++
+		} else {
+			j++
+		}
+	}
+	return res
+}
+
+// The runes in this set but not the other.
+func (self runeSet) subtract(other runeSet) runeSet {
+	return self.intersect(other.invert())
+}
+
+// Everything not in the set.
+func (self runeSet) invert() runeSet {
+	res := runeSet{}
+	next := rune(0)
+	for _, x := range self {
+		if x.lo > next {
+			res = append(res, runeRange{next, x.lo - 1})
+		}
+		next = x.hi + 1
+	}
+	if next <= unicode.MaxRune {
+		res = append(res, runeRange{next, unicode.MaxRune})
+	}
+	return res
+}
+
+// The runes that have other cases. These are found the first time they are
+// needed, so that folding a large set only has to look at the runes that
+// could make a difference.
+var (
+	foldableOnce sync.Once
+	foldableSet  runeSet
+)
+
+func foldable() runeSet {
+	foldableOnce.Do(func() {
+		rs := []runeRange{}
+		for c := rune(0); c <= unicode.MaxRune; c++ {
+			if unicode.SimpleFold(c) != c {
+				rs = append(rs, runeRange{c, c})
+			}
+		}
+		foldableSet = makeSet(rs)
+	})
+	return foldableSet
+}
+
+// The set, along with all of the other cases of its members.
+func (self runeSet) fold() runeSet {
+	rs := append([]runeRange{}, self...)
+	for _, x := range self.intersect(foldable()) {
+		for c := x.lo; c <= x.hi; c++ {
+			for f := unicode.SimpleFold(c); f != c; f = unicode.SimpleFold(f) {
+				rs = append(rs, runeRange{f, f})
+			}
+		}
+	}
+	return makeSet(rs)
+}
+
+func tableSet(t *unicode.RangeTable) runeSet {
+	rs := []runeRange{}
+	for _, x := range t.R16 {
+		rs = appendStride(rs, rune(x.Lo), rune(x.Hi), rune(x.Stride))
+	}
+	for _, x := range t.R32 {
+		rs = appendStride(rs, rune(x.Lo), rune(x.Hi), rune(x.Stride))
+	}
+	return makeSet(rs)
+}
+
+func appendStride(rs []runeRange, lo, hi, stride rune) []runeRange {
+	if stride == 1 {
+		return append(rs, runeRange{lo, hi})
+	}
+	for c := lo; c <= hi; c += stride {
+		rs = append(rs, runeRange{c, c})
+	}
+	return rs
+}
@@ -1,10 +1,9 @@
 package lexer
 
 import (
-	"bytes"
-	"container/list"
-	"errors"
+	"strconv"
 	"strings"
+	"unicode"
 
 	bwlerrors "github.com/bobappleyard/bwl/errors"
 )
@@ -55,231 +54,380 @@ func (self *Lexer) Regexes(m, regexes RegexSet) {
 	}
 }
 
+// A Regex finds matches of a single expression in strings. By default, where
+// several matches start at the same place the longest one is taken, as the
+// Lexer would. See SetFirst for the alternative. Matches of the empty string
+// are skipped over.
 type Regex struct {
-	l *Lexer
+	l     *Lexer
+	names []string
+	first bool
 }
 
 func NewRegex(re string, m RegexSet) *Regex {
 	l := New()
 	l.ForceRegex(re, m).SetFinal(0)
-	l.ForceRegex(".", nil).SetFinal(1)
-	return &Regex{l}
+	res := &Regex{l, []string{""}, false}
+	walk(l.root, func(s State) {
+		if c, ok := s.(*capState); ok && !c.end {
+			for len(res.names) <= c.group {
+				res.names = append(res.names, "")
+			}
+			res.names[c.group] = c.name
+		}
+	})
+	return res
 }
 
+// Choose between matches that start at the same place in the manner of Perl
+// (and RE2, and the standard regexp package): alternatives are tried from
+// left to right, repetitions go round as many times as they can (or as few,
+// for lazy ones like *?), and the first way that succeeds wins. Otherwise,
+// the longest match wins.
+func (self *Regex) SetFirst(on bool) {
+	self.first = on
+}
+
+// Whether the whole of s matches.
 func (self *Regex) Match(s string) bool {
 	self.l.StartString(s)
-	if self.l.Next() == 0 {
-		return self.l.Len() == len(s)
+	_, fin, end := self.l.match(0)
+	return fin == 0 && end == len([]rune(s))
+}
+
+// Find the next match starting at or after pos, returning where it starts and
+// ends, or -1, -1 if there are no more.
+func (self *Regex) find(buf []rune, pos int) (int, int) {
+	for ; pos < len(buf); pos++ {
+		end := -1
+		if self.first {
+			// going straight to the first match, rather than finding the
+			// longest one as well, stops as soon as the match is settled
+			end = firstMatch(self.l.root, 0, buf, pos)
+		} else if _, fin, e := self.l.match(pos); fin == 0 {
+			end = e
+		}
+		if end == -1 || end == pos {
+			continue
+		}
+		return pos, end
 	}
-	return false
+	return -1, -1
 }
 
-func (self *Regex) Matches(s string) []string {
-	res := make([]string, 0)
+// Go through up to n matches in s (all of them if n < 0), in order.
+func (self *Regex) each(s string, n int, f func(buf []rune, start, end int)) {
+	buf := []rune(s)
 	self.l.StartString(s)
-	for !self.l.Eof() {
-		if self.l.Next() == 0 {
-			res = append(res, self.l.String())
+	for pos, i := 0, 0; n < 0 || i < n; i++ {
+		start, end := self.find(buf, pos)
+		if start == -1 {
+			return
 		}
+		f(buf, start, end)
+		pos = end
 	}
+}
+
+func (self *Regex) Matches(s string) []string {
+	res := make([]string, 0)
+	self.each(s, -1, func(buf []rune, start, end int) {
+		res = append(res, string(buf[start:end]))
+	})
 	return res
 }
 
 func (self *Regex) Replace(s string, f func(string) string) string {
 	res := make([]string, 0)
-	buf := bytes.Runes([]byte(s))
 	last := 0
-	self.l.StartString(s)
-	for !self.l.Eof() {
-		if self.l.Next() == 0 {
-			res = append(res, string(buf[last:self.l.Pos()]))
-			res = append(res, f(self.l.String()))
-			last = self.l.Pos() + self.l.Len()
-		}
+	var buf []rune
+	self.each(s, -1, func(b []rune, start, end int) {
+		buf = b
+		res = append(res, string(buf[last:start]))
+		res = append(res, f(string(buf[start:end])))
+		last = end
+	})
+	if buf == nil {
+		return s
 	}
 	res = append(res, string(buf[last:]))
 	return strings.Join(res, "")
 }
 
-func Match(re, s string) bool {
-	expr := NewRegex(re, nil)
-	return expr.Match(s)
+/* Positions */
+
+// Where each rune in s begins, in bytes, followed by the length of s.
+func byteOffsets(s string) []int {
+	res := make([]int, 0, len(s)+1)
+	for i := range s {
+		res = append(res, i)
+	}
+	return append(res, len(s))
 }
 
-func Matches(re, s string) []string {
-	expr := NewRegex(re, nil)
-	return expr.Matches(s)
+// Find up to n matches (all of them if n < 0), and where they lie.
+func (self *Regex) spans(s string, n int) []Span {
+	var res []Span
+	offs := byteOffsets(s)
+	sizes := make([]uint8, len(offs)-1)
+	for i := range sizes {
+		sizes[i] = uint8(offs[i+1] - offs[i])
+	}
+	loc, last := startLocation, 0
+	self.each(s, n, func(buf []rune, start, end int) {
+		from := advance(loc, buf[last:start], sizes[last:start], 1)
+		to := advance(from, buf[start:end], sizes[start:end], 1)
+		res = append(res, Span{from, to})
+		loc, last = to, end
+	})
+	return res
 }
 
-func Replace(re, s string, f func(string) string) string {
-	expr := NewRegex(re, nil)
-	return expr.Replace(s, f)
+// Where the first match in s lies. The span gives its position in runes
+// (Pos) and in bytes (Offset), as well as by line and column. The bool is
+// false if there is no match.
+func (self *Regex) FindSpan(s string) (Span, bool) {
+	if ms := self.spans(s, 1); ms != nil {
+		return ms[0], true
+	}
+	return Span{}, false
 }
 
-type regexPos struct {
-	start, end *BasicState
+// Like FindSpan, but for up to n matches, or all of them if n < 0.
+func (self *Regex) FindAllSpan(s string, n int) []Span {
+	return self.spans(s, n)
 }
 
-func (self *BasicState) AddRegex(re string, m RegexSet) (*BasicState, error) {
-	if m == nil {
-		m = defaultMeta
+// The first match in s, as a pair of byte offsets. Returns nil if there is no
+// match.
+func (self *Regex) FindIndex(s string) []int {
+	if ms := self.FindAllIndex(s, 1); ms != nil {
+		return ms[0]
 	}
-	// this is just the sort of horror show that lexical analysis avoids
-
-	// stack machine
-	start := self
-	end := NewState()
-	stack := list.New()
-
-	// state flags
-	expr, esc, cs := false, false, false
-	setstr := ""
-
-	// go into a subexpression
-	push := func() {
-		rp := &regexPos{start, end}
-		stack.PushBack(rp)
-		end = NewState()
-		start.AddEmptyTransition(end)
+	return nil
+}
+
+// Like FindIndex, but for up to n matches, or all of them if n < 0.
+func (self *Regex) FindAllIndex(s string, n int) [][]int {
+	var res [][]int
+	for _, x := range self.spans(s, n) {
+		res = append(res, []int{x.Start.Offset, x.End.Offset})
 	}
-	// come out of a subexpression
-	pop := func() {
-		v := stack.Back()
-		stack.Remove(v)
-		rp := v.Value.(*regexPos)
-		end.AddEmptyTransition(rp.end)
-		start = rp.start
-		end = rp.end
+	return res
+}
+
+// Cut s up into the pieces between the matches. If n > 0, there are at most n
+// pieces, the last being the rest of s. If n == 0, there are none, and if
+// n < 0, there are as many as it takes.
+func (self *Regex) Split(s string, n int) []string {
+	if n == 0 {
+		return nil
 	}
-	// move forward, for the purposes of concatenation
-	move := func() {
-		start = end
-		end = NewState()
+	res := []string{}
+	last := 0
+	for _, x := range self.FindAllIndex(s, n-1) {
+		res = append(res, s[last:x[0]])
+		last = x[1]
 	}
+	return append(res, s[last:])
+}
 
-	// the expression is inside an implicit ( ... )
-	push()
-
-	// parse the expression
-	for _, c := range re {
-		// escaped characters
-		if esc {
-			esc = false
-			// inside a charset jobby
-			if cs {
-				setstr += string(c)
-				continue
-			}
-			// check out the metachar action
-			if meta, ok := m[c]; ok {
-				move()
-				chars, err := Charset(meta, end)
-				if err != nil {
-					return nil, err
-				}
-				start.AddEmptyTransition(chars)
-				expr = true
-				continue
+/* Submatches */
+
+// The number of capture groups in the expression.
+func (self *Regex) NumSubexp() int {
+	return len(self.names) - 1
+}
+
+// The names of the capture groups, indexed by group number. Unnamed groups,
+// and the match as a whole (group 0), have empty names.
+func (self *Regex) SubexpNames() []string {
+	return self.names
+}
+
+// The number of the group with the given name, or -1 if there is no such
+// group.
+func (self *Regex) SubexpIndex(name string) int {
+	if name != "" {
+		for i, x := range self.names {
+			if x == name {
+				return i
 			}
-			// nothing else going on? well you escaped it for a reason
-			goto add
 		}
-		// charsets
-		if cs {
-			if c == '\\' {
-				esc = true
-			} else if c == ']' {
-				chars, err := Charset(setstr, end)
-				if err != nil {
-					return nil, err
-				}
-				start.AddEmptyTransition(chars)
-				setstr = ""
-				cs = false
-				expr = true
-			} else {
-				setstr += string(c)
+	}
+	return -1
+}
+
+// Find up to n matches (all of them if n < 0), with the positions of their
+// capture groups. Positions are byte offsets into s.
+func (self *Regex) submatches(s string, n int) [][]int {
+	var res [][]int
+	offs := byteOffsets(s)
+	self.each(s, n, func(buf []rune, start, end int) {
+		caps := submatch(self.l.root, 0, self.NumSubexp(), buf, start, end)
+		for i, x := range caps {
+			if x != -1 {
+				caps[i] = offs[x]
 			}
+		}
+		res = append(res, caps)
+	})
+	return res
+}
+
+func groupText(s string, caps []int) []string {
+	res := make([]string, len(caps)/2)
+	for i := range res {
+		if caps[2*i] != -1 {
+			res[i] = s[caps[2*i]:caps[2*i+1]]
+		}
+	}
+	return res
+}
+
+// The first match in s, followed by the text of each of its capture groups.
+// Returns nil if there is no match.
+func (self *Regex) FindSubmatch(s string) []string {
+	if ms := self.submatches(s, 1); ms != nil {
+		return groupText(s, ms[0])
+	}
+	return nil
+}
+
+// The positions of the first match in s and of its capture groups, as byte
+// offsets in pairs. A group that did not take part in the match is at -1.
+func (self *Regex) FindSubmatchIndex(s string) []int {
+	if ms := self.submatches(s, 1); ms != nil {
+		return ms[0]
+	}
+	return nil
+}
+
+// Like FindSubmatch, but for up to n matches, or all of them if n < 0.
+func (self *Regex) FindAllSubmatch(s string, n int) [][]string {
+	ms := self.submatches(s, n)
+	if ms == nil {
+		return nil
+	}
+	res := make([][]string, len(ms))
+	for i, x := range ms {
+		res[i] = groupText(s, x)
+	}
+	return res
+}
+
+// Like FindSubmatchIndex, but for up to n matches, or all of them if n < 0.
+func (self *Regex) FindAllSubmatchIndex(s string, n int) [][]int {
+	return self.submatches(s, n)
+}
+
+/* Templates */
+
+// Replace each match in s with template, in which $1 or ${1} stands for the
+// text of the first group, $name or ${name} for that of the group called name,
+// and $$ for a dollar sign. A name runs for as long as there are letters,
+// digits and underscores, so $1x means ${1x} rather than ${1}x. Groups that
+// don't exist or didn't take part in the match are replaced by nothing.
+func (self *Regex) ReplaceTemplate(s, template string) string {
+	var res []byte
+	last := 0
+	for _, caps := range self.submatches(s, -1) {
+		res = append(res, s[last:caps[0]]...)
+		res = self.expand(res, template, s, caps)
+		last = caps[1]
+	}
+	return string(append(res, s[last:]...))
+}
+
+func (self *Regex) expand(res []byte, template, s string, caps []int) []byte {
+	for {
+		i := strings.IndexByte(template, '$')
+		if i == -1 {
+			break
+		}
+		res = append(res, template[:i]...)
+		template = template[i+1:]
+		if strings.HasPrefix(template, "$") {
+			res = append(res, '$')
+			template = template[1:]
 			continue
 		}
-		// everything else
-		switch c {
-		// charsets
-		case '.':
-			move()
-			start.AddEmptyTransition(Any(end))
-			expr = true
-		case '[':
-			move()
-			cs = true
-		case ']':
-			if !cs {
-				return nil, errors.New("trying to close unopened charset")
-			}
-		// grouping
-		case '(':
-			move()
-			push()
-			expr = false
-		case ')':
-			if stack.Len() <= 1 {
-				return nil, errors.New("trying to close unopened subexpr")
-			}
-			pop()
-			expr = true
-		// alternation
-		case '|':
-			pop()
-			push()
-			expr = false
-		// modifiers
-		case '?':
-			start.AddEmptyTransition(end)
-			goto check
-		case '*':
-			start.AddEmptyTransition(end)
-			end.AddEmptyTransition(start)
-			goto check
-		case '+':
-			end.AddEmptyTransition(start)
-			goto check
-		// escape character
-		case '\\':
-			esc = true
-			expr = false
-		// otherwise just add that char
-		default:
-			goto add
+		name, rest, ok := templateName(template)
+		if !ok {
+			// not a reference after all
+			res = append(res, '$')
+			continue
+		}
+		template = rest
+		g, err := strconv.Atoi(name)
+		if err != nil {
+			g = self.SubexpIndex(name)
 		}
-		continue
-		// make sure the modifier modified something
-	check:
-		if !expr {
-			return nil, errors.New("nothing to modify")
+		if g >= 0 && 2*g < len(caps) && caps[2*g] != -1 {
+			res = append(res, s[caps[2*g]:caps[2*g+1]]...)
 		}
-		expr = false
-		continue
-		// add a character transition
-	add:
-		move()
-		start.AddTransition(c, end)
-		expr = true
-		continue
 	}
+	return append(res, template...)
+}
 
-	// some final consistency checks
-	if cs {
-		return nil, errors.New("unclosed charset")
+// Pull a group reference off the front of a template, just after the $.
+func templateName(t string) (string, string, bool) {
+	brace := strings.HasPrefix(t, "{")
+	if brace {
+		t = t[1:]
+	}
+	n := len(t)
+	for i, c := range t {
+		if !(c == '_' || unicode.IsLetter(c) || unicode.IsDigit(c)) {
+			n = i
+			break
+		}
 	}
-	if esc {
-		return nil, errors.New("invalid escape sequence")
+	if n == 0 {
+		return "", "", false
 	}
-	if stack.Len() > 1 {
-		return nil, errors.New("unclosed subexpr")
+	name, rest := t[:n], t[n:]
+	if brace {
+		if !strings.HasPrefix(rest, "}") {
+			return "", "", false
+		}
+		rest = rest[1:]
 	}
+	return name, rest, true
+}
+
+func Match(re, s string) bool {
+	expr := NewRegex(re, nil)
+	return expr.Match(s)
+}
+
+func Matches(re, s string) []string {
+	expr := NewRegex(re, nil)
+	return expr.Matches(s)
+}
 
-	// close the implicit brackets
-	pop()
+func Replace(re, s string, f func(string) string) string {
+	expr := NewRegex(re, nil)
+	return expr.Replace(s, f)
+}
 
-	return end, nil
+// Add the states for a regular expression, starting from this state. Returns
+// the state that the expression finishes on, which can then be made final.
+// Errors in the expression are returned as *RegexError.
+func (self *BasicState) AddRegex(re string, m RegexSet) (*BasicState, error) {
+	n, err := ParseRegex(re, m)
+	if err != nil {
+		return nil, err
+	}
+	return self.AddTree(n)
+}
+
+// Add the states for a lexer rule, starting from this state, as AddRegex
+// does. The rule may have trailing context (see ParseRule).
+func (self *BasicState) AddRule(re string, m RegexSet) (*BasicState, error) {
+	n, err := ParseRule(re, m)
+	if err != nil {
+		return nil, err
+	}
+	return self.AddTree(n)
 }
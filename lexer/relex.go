@@ -0,0 +1,120 @@
+package lexer
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+/* Incremental lexing */
+
+// When the input changes a little, most of its tokens stay the same. Each
+// token remembers how far into the input the Lexer looked to match it, and the
+// mode stack it left behind. The tokens that only looked at input before a
+// change can be kept as they are, and lexing can start again from the end of
+// the last of them. Once the new tokens have got past the change, and the
+// Lexer is at a place where one of the old tokens ended, in the same mode,
+// what follows is bound to be the same as before, so the rest of the old
+// tokens can be kept too, once they have been moved along.
+
+// A change to the input: Deleted runes were taken out at Pos (counted in runes
+// from the beginning of the input), and Inserted was put in their place.
+type Edit struct {
+	Pos      int
+	Deleted  int
+	Inserted string
+}
+
+// Which tokens a change affected: the old tokens[Start:OldEnd] were replaced
+// with the new tokens[Start:NewEnd].
+type Changed struct {
+	Start, OldEnd, NewEnd int
+}
+
+// Bring the tokens for some input up to date after it has been edited. Given
+// the tokens from before (as produced by Tokens()), the input as it is now and
+// the edit that was made, it returns the tokens for the input as it is now
+// and which of them are new. Only the tokens around the edit are matched
+// again: the rest are kept, with their spans moved along. The Scanner is left
+// part way through the input.
+func (self *Scanner) Relex(old []Token, text string, e Edit) ([]Token, Changed, error) {
+	// the tokens that didn't look as far as the edit are unaffected
+	start := 0
+	for start < len(old) && old[start].look <= e.Pos {
+		start++
+	}
+	from := startLocation
+	var stack *modeStack
+	if start > 0 {
+		from, stack = old[start-1].Span.End, old[start-1].after
+	}
+	self.resume(text, from, stack)
+
+	// where runes after the edit have moved to
+	shift := utf8.RuneCountInString(e.Inserted) - e.Deleted
+	end := e.Pos + e.Deleted
+	res := append([]Token(nil), old[:start]...)
+	next := start
+	for tok, err := range self.Tokens() {
+		if err != nil {
+			return nil, Changed{}, err
+		}
+		res = append(res, tok)
+		// the same place in the old input, which has to be past the edit
+		// (and the rune before it too, for assertions)
+		pos := self.pos - shift
+		if pos <= end {
+			continue
+		}
+		for next < len(old) && old[next].Span.End.Pos < pos {
+			next++
+		}
+		if next == len(old) {
+			continue
+		}
+		was := old[next].Span.End
+		if was.Pos != pos || !old[next].after.equal(self.stack) {
+			continue
+		}
+		// tabs later on the line have to line up as before
+		if (self.loc.Col-was.Col)%self.tab != 0 {
+			continue
+		}
+		n := len(res)
+		for _, tok := range old[next+1:] {
+			tok.Span.Start = moveLocation(tok.Span.Start, was, self.loc)
+			tok.Span.End = moveLocation(tok.Span.End, was, self.loc)
+			tok.look += shift
+			res = append(res, tok)
+		}
+		return res, Changed{start, next + 1, n}, nil
+	}
+	return res, Changed{start, len(old), len(res)}, nil
+}
+
+// Start again part way through some input, at loc, with the given mode stack.
+func (self *Scanner) resume(text string, loc Location, stack *modeStack) {
+	self.start(strings.NewReader(text[loc.Offset:]))
+	self.stack = stack
+	self.pos, self.startPos = loc.Pos, loc.Pos
+	self.loc, self.startLoc = loc, loc
+	self.base = loc.Pos
+	if loc.Pos > 0 {
+		// the rune before, for assertions
+		c, n := utf8.DecodeLastRuneInString(text[:loc.Offset])
+		self.buf = append(self.buf, c)
+		self.sizes = append(self.sizes, uint8(n))
+		self.base--
+	}
+}
+
+// Move a location that came after was in the old input, given that was is now
+// at is. Columns only change on the same line.
+func moveLocation(loc, was, is Location) Location {
+	if loc.Line == was.Line {
+		loc.Col += is.Col - was.Col
+	}
+	loc.Pos += is.Pos - was.Pos
+	loc.Offset += is.Offset - was.Offset
+	loc.Line += is.Line - was.Line
+	return loc
+}
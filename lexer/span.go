@@ -0,0 +1,67 @@
+package lexer
+
+import (
+	"fmt"
+)
+
+/* Locations in the input */
+
+// A place in the input. Lines and columns count from 1.
+type Location struct {
+	// runes from the beginning of the input
+	Pos int
+	// bytes from the beginning of the input
+	Offset int
+	Line   int
+	Col    int
+}
+
+func (self Location) String() string {
+	return fmt.Sprintf("%d:%d", self.Line, self.Col)
+}
+
+// The stretch of input a token covers, from its first rune up to (but not
+// including) the rune after its last.
+type Span struct {
+	Start, End Location
+}
+
+func (self Span) String() string {
+	return fmt.Sprintf("%s-%s", self.Start, self.End)
+}
+
+var startLocation = Location{0, 0, 1, 1}
+
+// Move a location on over some runes, that took up the given number of bytes
+// each in the input.
+func advance(loc Location, rs []rune, sizes []uint8, tab int) Location {
+	for i, c := range rs {
+		loc.Pos++
+		loc.Offset += int(sizes[i])
+		switch c {
+		case '\n':
+			loc.Line++
+			loc.Col = 1
+		case '\t':
+			loc.Col = (loc.Col-1)/tab*tab + tab + 1
+		default:
+			loc.Col++
+		}
+	}
+	return loc
+}
+
+// Set how many columns a tab character takes up. Tabs move on to the next
+// column that is a multiple of this (plus one, as columns count from 1). The
+// default is 1, so tabs count as any other character.
+func (self *Scanner) SetTabWidth(n int) {
+	if n < 1 {
+		n = 1
+	}
+	self.tab = n
+}
+
+// Where the current token lies in the input.
+func (self *Scanner) Span() Span {
+	return Span{self.startLoc, self.loc}
+}
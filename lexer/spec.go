@@ -0,0 +1,92 @@
+package lexer
+
+import (
+	"io"
+	"strings"
+	"sync"
+)
+
+/* Frozen rules */
+
+// A Spec is a set of rules that can no longer be changed, so that it can be
+// shared between goroutines. Each goroutine scans its own input with its own
+// Scanner, and the DFA worked out by any of them is there for all of them.
+// Following the parts of the DFA that have already been worked out only takes
+// a read lock, so goroutines only hold each other up while the DFA is growing.
+type Spec struct {
+	modes map[string]*BasicState
+	// the DFA worked out in full, where that can be done
+	table *Table
+	mu    sync.RWMutex
+	dfa   *dfa
+}
+
+// the rules for a mode that has none
+var noRules = NewState()
+
+// Freeze the Lexer's rules. Where the rules allow it, the whole of the DFA is
+// worked out straight away and minimised, so that scanning is just a matter of
+// looking things up in tables. Otherwise (where the rules use assertions, or
+// the DFA would be too big), the DFA is built as the input demands it, as for
+// a Lexer. The Spec has a copy of the rules, so changing the
+// Lexer afterwards makes no difference to it. States from outside this package
+// can't be copied, so they are shared, and had better not change. The same
+// goes for actions, which may be run from several goroutines at once.
+func (self *Lexer) Spec() *Spec {
+	c := copier{}
+	modes := make(map[string]*BasicState, len(self.modes))
+	for name, root := range self.modes {
+		modes[name] = c.copy(root).(*BasicState)
+	}
+	res := &Spec{modes: modes, dfa: newDfa()}
+	res.dfa.frozen = true
+	res.table, _ = buildTable(modes, maxDfaStates)
+	return res
+}
+
+// Start scanning some input.
+func (self *Spec) Scan(src io.Reader) *Scanner {
+	res := &Scanner{spec: self, tab: 1}
+	res.start(src)
+	return res
+}
+
+func (self *Spec) ScanString(src string) *Scanner {
+	return self.Scan(strings.NewReader(src))
+}
+
+// Break a string up into tokens.
+func (self *Spec) Tokenize(s string) ([]Token, error) {
+	return collect(self.ScanString(s).Tokens())
+}
+
+func (self *Spec) root(mode string) State {
+	if res, ok := self.modes[mode]; ok {
+		return res
+	}
+	return noRules
+}
+
+func (self *Spec) start(root State, prev rune, peek func() rune) *dfaState {
+	self.mu.RLock()
+	res, ok := self.dfa.cachedStart(root, prev, peek)
+	self.mu.RUnlock()
+	if ok {
+		return res
+	}
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.dfa.start(root, prev, peek)
+}
+
+func (self *Spec) step(from *dfaState, c rune, peek func() rune) *dfaState {
+	self.mu.RLock()
+	res, ok := self.dfa.cachedStep(from, c, peek)
+	self.mu.RUnlock()
+	if ok {
+		return res
+	}
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.dfa.step(from, c, peek)
+}
@@ -1,8 +1,7 @@
 package lexer
 
 import (
-	"errors"
-	"strings"
+	"sort"
 )
 
 /* States */
@@ -24,6 +23,18 @@ type BasicState struct {
 	transitions map[rune]State
 	empty       []State
 	final       int
+	change      modeChange
+	action      Action
+	// how many runes at the end of a match are trailing context, or FAIL if
+	// that varies
+	trail    int
+	watchers watchers
+}
+
+// What happens to the Lexer's mode stack when it finishes on a state.
+type modeChange struct {
+	pop, push bool
+	mode      string
 }
 
 func NewState() *BasicState {
@@ -31,6 +42,10 @@ func NewState() *BasicState {
 		make(map[rune]State),
 		make([]State, 0),
 		-1,
+		modeChange{},
+		nil,
+		0,
+		nil,
 	}
 }
 
@@ -54,24 +69,42 @@ func (self *BasicState) Final() int {
 
 func (self *BasicState) AddTransition(c rune, s State) {
 	self.transitions[c] = s
+	self.watchers.touch()
 }
 
 func (self *BasicState) AddEmptyTransition(s State) {
 	self.empty = append(self.empty, s)
+	self.watchers.touch()
 }
 
 func (self *BasicState) SetFinal(f int) {
 	self.final = f
+	self.watchers.touch()
+}
+
+// Have the Lexer enter a mode when it finishes on this state.
+func (self *BasicState) PushMode(mode string) {
+	self.change.push = true
+	self.change.mode = mode
+}
+
+// Have the Lexer go back to the mode it was in before the current one when it
+// finishes on this state. If both this and PushMode are called, the current
+// mode is replaced.
+func (self *BasicState) PopMode() {
+	self.change.pop = true
 }
 
 /* More specialised stuff */
 
 type SpecialState struct {
-	next []State
+	next     []State
+	watchers watchers
 }
 
 func (self *SpecialState) SetNext(next State) {
 	self.next = []State{next}
+	self.watchers.touch()
 }
 
 func (self *SpecialState) Move(c rune) []State {
@@ -96,54 +129,180 @@ func Any(next State) State {
 
 /* A state with charset stuff */
 
+// The runes that the state lets through are held as a set of ranges, with any
+// inversion and case folding already worked in.
 type csState struct {
 	SpecialState
-	chars string
-	inv   bool
+	set runeSet
 }
 
 func Charset(spec string, next State) (State, error) {
-	start := rune(0)
-	inrange, inv := false, false
-	chars := ""
-	res := new(csState)
-	res.SetNext(next)
-	if spec == "" {
-		return res, nil
-	} // this will allow nothing past
-	if spec[0] == '^' {
-		inv = true
-		spec = spec[1:]
+	c, err := parseSpec(spec)
+	if err != nil {
+		return nil, err
 	}
-	for _, x := range spec {
-		switch {
-		case x == '-':
-			inrange = true
-		case inrange:
-			if start == 0 || x <= start {
-				return nil, errors.New("invalid range specification")
-			}
-			for i := start + 1; i <= x; i++ {
-				chars += string(i)
-			}
-			inrange = false
-		default:
-			chars += string(x)
-			start = x
-		}
-	}
-	res.chars = chars
-	res.inv = inv
-	return res, nil
+	return classState(c, next)
 }
 
 func (self *csState) Move(c rune) []State {
-	found := strings.Index(self.chars, string(c)) != -1
-	if self.inv {
-		found = !found
-	}
-	if found {
+	if self.set.has(c) {
 		return self.SpecialState.next
 	}
 	return []State{}
 }
+
+/* Capture group boundaries */
+
+// Marks where a capture group begins or ends. As far as matching is
+// concerned, this is just an empty transition.
+type capState struct {
+	next  []State
+	group int
+	end   bool
+	name  string
+}
+
+func (self *capState) Move(c rune) []State {
+	return []State{}
+}
+
+func (self *capState) Close() []State {
+	return self.next
+}
+
+func (self *capState) Final() int {
+	return -1
+}
+
+/* Assertions */
+
+// An Assertion is a state whose empty transitions are only followed when the
+// input either side of the current position meets some condition. prev and
+// next are FAIL at the beginning and end of the input respectively.
+type Assertion interface {
+	State
+	Assert(prev, next rune) bool
+}
+
+type AssertKind int
+
+const (
+	BeginText AssertKind = iota
+	EndText
+	BeginLine
+	EndLine
+	WordBoundary
+	NotWordBoundary
+)
+
+type assertState struct {
+	next []State
+	kind AssertKind
+}
+
+// Create an assertion of the given kind, leading on to next.
+func Assert(kind AssertKind, next State) State {
+	return &assertState{[]State{next}, kind}
+}
+
+func (self *assertState) Move(c rune) []State {
+	return []State{}
+}
+
+func (self *assertState) Close() []State {
+	return self.next
+}
+
+func (self *assertState) Final() int {
+	return -1
+}
+
+func (self *assertState) Assert(prev, next rune) bool {
+	switch self.kind {
+	case BeginText:
+		return prev == FAIL
+	case EndText:
+		return next == FAIL
+	case BeginLine:
+		return prev == FAIL || prev == '\n'
+	case EndLine:
+		return next == FAIL || next == '\n'
+	case WordBoundary:
+		return isWord(prev) != isWord(next)
+	case NotWordBoundary:
+		return isWord(prev) == isWord(next)
+	}
+	return false
+}
+
+func isWord(c rune) bool {
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+}
+
+// The kinds of rune that the assertions above are able to tell apart. The
+// DFA keeps its transitions separate for each of these.
+const (
+	ctxNone = iota
+	ctxNewline
+	ctxWord
+	ctxOther
+	ctxClasses
+)
+
+func class(c rune) int {
+	switch {
+	case c == FAIL:
+		return ctxNone
+	case c == '\n':
+		return ctxNewline
+	case isWord(c):
+		return ctxWord
+	}
+	return ctxOther
+}
+
+/* Graph traversal */
+
+// All of the states directly reachable from a state, for those states that
+// this package knows about.
+func successors(s State) []State {
+	switch s := s.(type) {
+	case *BasicState:
+		cs := make([]int, 0, len(s.transitions))
+		for c := range s.transitions {
+			cs = append(cs, int(c))
+		}
+		sort.Ints(cs)
+		res := make([]State, 0, len(s.transitions)+len(s.empty))
+		for _, c := range cs {
+			res = append(res, s.transitions[rune(c)])
+		}
+		return append(res, s.empty...)
+	case *SpecialState:
+		return s.next
+	case *csState:
+		return s.next
+	case *capState:
+		return s.next
+	case *assertState:
+		return s.next
+	}
+	return nil
+}
+
+// Visit every state reachable from a given state, once each.
+func walk(s State, f func(State)) {
+	seen := make(map[State]bool)
+	var visit func(s State)
+	visit = func(s State) {
+		if seen[s] {
+			return
+		}
+		seen[s] = true
+		f(s)
+		for _, x := range successors(s) {
+			visit(x)
+		}
+	}
+	visit(s)
+}
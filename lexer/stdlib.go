@@ -0,0 +1,112 @@
+package lexer
+
+import (
+	"fmt"
+	"regexp/syntax"
+)
+
+/* Trees from the standard library */
+
+// Turn an expression parsed by the regexp/syntax package into a syntax tree,
+// so that patterns can be checked with the standard parser and then matched
+// by the Lexer. Every op that the package produces has a counterpart here,
+// with the same meaning; an error is returned for any that don't.
+func FromSyntax(re *syntax.Regexp) (Node, error) {
+	subs := func() ([]Node, error) {
+		res := make([]Node, len(re.Sub))
+		for i, x := range re.Sub {
+			n, err := FromSyntax(x)
+			if err != nil {
+				return nil, err
+			}
+			res[i] = n
+		}
+		return res, nil
+	}
+	switch re.Op {
+	case syntax.OpNoMatch:
+		return Class{}, nil
+	case syntax.OpEmptyMatch:
+		return Concat{}, nil
+	case syntax.OpLiteral:
+		fold := re.Flags&syntax.FoldCase != 0
+		if len(re.Rune) == 1 {
+			return Literal{re.Rune[0], fold}, nil
+		}
+		res := make(Concat, len(re.Rune))
+		for i, c := range re.Rune {
+			res[i] = Literal{c, fold}
+		}
+		return res, nil
+	case syntax.OpCharClass:
+		res := Class{}
+		for i := 0; i+1 < len(re.Rune); i += 2 {
+			res.Ranges = append(res.Ranges, ClassRange{re.Rune[i], re.Rune[i+1]})
+		}
+		return res, nil
+	case syntax.OpAnyCharNotNL:
+		return Class{Negate: true, Ranges: []ClassRange{{'\n', '\n'}}}, nil
+	case syntax.OpAnyChar:
+		return AnyChar{}, nil
+	case syntax.OpBeginLine:
+		return Anchor{BeginLine}, nil
+	case syntax.OpEndLine:
+		return Anchor{EndLine}, nil
+	case syntax.OpBeginText:
+		return Anchor{BeginText}, nil
+	case syntax.OpEndText:
+		return Anchor{EndText}, nil
+	case syntax.OpWordBoundary:
+		return Anchor{WordBoundary}, nil
+	case syntax.OpNoWordBoundary:
+		return Anchor{NotWordBoundary}, nil
+	case syntax.OpCapture:
+		sub, err := FromSyntax(re.Sub[0])
+		if err != nil {
+			return nil, err
+		}
+		return Group{sub, re.Cap, re.Name}, nil
+	case syntax.OpStar, syntax.OpPlus, syntax.OpQuest, syntax.OpRepeat:
+		min, max := re.Min, re.Max
+		switch re.Op {
+		case syntax.OpStar:
+			min, max = 0, -1
+		case syntax.OpPlus:
+			min, max = 1, -1
+		case syntax.OpQuest:
+			min, max = 0, 1
+		}
+		if err := checkRepeat(min, max); err != nil {
+			return nil, err
+		}
+		sub, err := FromSyntax(re.Sub[0])
+		if err != nil {
+			return nil, err
+		}
+		return Repeat{sub, min, max, re.Flags&syntax.NonGreedy != 0}, nil
+	case syntax.OpConcat:
+		res, err := subs()
+		if err != nil {
+			return nil, err
+		}
+		return Concat(res), nil
+	case syntax.OpAlternate:
+		res, err := subs()
+		if err != nil {
+			return nil, err
+		}
+		return Alt(res), nil
+	}
+	return nil, fmt.Errorf("cannot compile %v", re.Op)
+}
+
+// Add the states for an expression parsed by the regexp/syntax package,
+// starting from this state. Returns the state that the expression finishes
+// on, as AddTree does.
+func (self *BasicState) AddSyntax(re *syntax.Regexp) (*BasicState, error) {
+	n, err := FromSyntax(re)
+	if err != nil {
+		return nil, err
+	}
+	return self.AddTree(n)
+}
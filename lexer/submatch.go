@@ -0,0 +1,124 @@
+package lexer
+
+/* Submatch extraction */
+
+// Once the Lexer has found where a match lies, the capture groups are filled
+// in by running the NFA again over just that stretch of the input, keeping
+// one thread per state in the manner of Pike's VM. The threads are kept in
+// priority order, so where there is a choice the leftmost alternative and the
+// greedier repetition win.
+
+type thread struct {
+	s    State
+	caps []int
+}
+
+func addThread(list []thread, seen map[State]bool, s State, caps []int, buf []rune, pos int) []thread {
+	if seen[s] {
+		return list
+	}
+	seen[s] = true
+	if a, ok := s.(Assertion); ok {
+		prev, next := rune(FAIL), rune(FAIL)
+		if pos > 0 {
+			prev = buf[pos-1]
+		}
+		if pos < len(buf) {
+			next = buf[pos]
+		}
+		if !a.Assert(prev, next) {
+			return list
+		}
+	}
+	if c, ok := s.(*capState); ok && caps != nil {
+		i := 2 * c.group
+		if c.end {
+			i++
+		}
+		if i < len(caps) {
+			caps = append([]int(nil), caps...)
+			caps[i] = pos
+		}
+	}
+	list = append(list, thread{s, caps})
+	for _, x := range s.Close() {
+		list = addThread(list, seen, x, caps, buf, pos)
+	}
+	return list
+}
+
+// Work out the positions of the capture groups for a match of final state id
+// covering buf[start:end]. Groups that took no part in the match are given
+// positions of -1.
+func submatch(root State, id, groups int, buf []rune, start, end int) []int {
+	caps := make([]int, 2*(groups+1))
+	for i := range caps {
+		caps[i] = -1
+	}
+	caps[0], caps[1] = start, end
+	for _, t := range run(root, caps, buf, start, end) {
+		if t.s.Final() == id {
+			return t.caps
+		}
+	}
+	return nil
+}
+
+// Where the part of a match of rule covering buf[start:end] that comes before
+// its trailing context ends.
+func contextEnd(root, rule State, buf []rune, start, end int) int {
+	for _, t := range run(root, []int{start, end}, buf, start, end) {
+		if t.s == rule {
+			return t.caps[1]
+		}
+	}
+	return end
+}
+
+// Run the threads over buf[start:end], returning the ones left at the end in
+// priority order.
+func run(root State, caps []int, buf []rune, start, end int) []thread {
+	this := addThread(nil, make(map[State]bool), root, caps, buf, start)
+	for pos := start; pos < end; pos++ {
+		next := []thread{}
+		seen := make(map[State]bool)
+		for _, t := range this {
+			for _, x := range t.s.Move(buf[pos]) {
+				next = addThread(next, seen, x, t.caps, buf, pos+1)
+			}
+		}
+		this = next
+	}
+	return this
+}
+
+// Where the match of final state id starting at buf[start] ends, when matching
+// leftmost-first: the threads are run in priority order, and once one of them
+// finishes, the ones behind it are dropped. Matches of the empty string are
+// passed over. Returns -1 if there is no match.
+func firstMatch(root State, id int, buf []rune, start int) int {
+	res := -1
+	this := addThread(nil, make(map[State]bool), root, nil, buf, start)
+	for pos := start; len(this) > 0; pos++ {
+		if pos > start {
+			for i, t := range this {
+				if t.s.Final() == id {
+					this, res = this[:i], pos
+					break
+				}
+			}
+		}
+		if pos == len(buf) {
+			break
+		}
+		next := []thread{}
+		seen := make(map[State]bool)
+		for _, t := range this {
+			for _, x := range t.s.Move(buf[pos]) {
+				next = addThread(next, seen, x, nil, buf, pos+1)
+			}
+		}
+		this = next
+	}
+	return res
+}
@@ -0,0 +1,930 @@
+package lexer
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+/* Syntax trees */
+
+// A Node is a part of a parsed regular expression. AddRegex parses an
+// expression into a tree of these, and then hands the tree to AddTree to make
+// the states. In between, the tree can be looked at, rearranged or printed
+// back out again: String() gives the node in the regex language.
+type Node interface {
+	String() string
+}
+
+// A single character. If Fold is set, the other cases of the character match
+// as well.
+type Literal struct {
+	Char rune
+	Fold bool
+}
+
+// Any character at all.
+type AnyChar struct{}
+
+// A set of characters. The set is made up of the characters in Ranges, In,
+// Out and Nested, with Ops then applied in order. Case folding is applied to
+// the result, and then negation.
+type Class struct {
+	// match the characters that are not in the set
+	Negate bool
+	Ranges []ClassRange
+	// the names of Unicode categories or scripts that the set includes, and
+	// of those whose complements the set includes
+	In, Out []string
+	// sets written inside this one, as in [a-z[0-9]]
+	Nested []Class
+	Ops    []ClassOp
+	Fold   bool
+}
+
+type ClassRange struct {
+	Lo, Hi rune
+}
+
+// What to do to a set with another set.
+type SetOp int
+
+const (
+	// keep what is in both, as in [a-z&&[^aeiou]]
+	Intersect SetOp = iota
+	// take away what is in the other set, as in [\p{L}--[a-z]]
+	Subtract
+)
+
+type ClassOp struct {
+	Op    SetOp
+	Class Class
+}
+
+// Expressions one after another. An empty Concat matches the empty string.
+type Concat []Node
+
+// A choice of expressions, with the earlier ones preferred.
+type Alt []Node
+
+// An expression repeated at least Min times and at most Max times. Max is -1
+// where there is no limit. A repetition is greedy unless Lazy is set, which
+// only makes a difference to leftmost-first matching (see Regex).
+type Repeat struct {
+	Sub      Node
+	Min, Max int
+	Lazy     bool
+}
+
+// A capture group. Groups are numbered from 1.
+type Group struct {
+	Sub   Node
+	Index int
+	Name  string
+}
+
+// Matches the empty string, in places where an assertion holds.
+type Anchor struct {
+	Kind AssertKind
+}
+
+// Sub, but only where Context follows it, as in flex's r/s (see ParseRule).
+// The whole of Sub and Context is matched, for choosing between rules, but
+// only Sub is taken from the input. Trailing context can only come at the top
+// of a tree.
+type Trailing struct {
+	Sub, Context Node
+}
+
+/* Printing trees */
+
+const metaChars = `\.+*?()|[]{}^$/`
+
+func escapeChar(c rune, special string) string {
+	switch c {
+	case '\n':
+		return `\n`
+	case '\t':
+		return `\t`
+	case '\r':
+		return `\r`
+	}
+	if strings.ContainsRune(special, c) {
+		return `\` + string(c)
+	}
+	return string(c)
+}
+
+func foldString(s string, fold bool) string {
+	if fold {
+		return "(?i:" + s + ")"
+	}
+	return s
+}
+
+func (self Literal) String() string {
+	return foldString(escapeChar(self.Char, metaChars), self.Fold)
+}
+
+func (self AnyChar) String() string {
+	return "."
+}
+
+func (self Class) String() string {
+	return foldString(self.brackets(), self.Fold)
+}
+
+// The set in brackets, leaving aside folding, which can't be written inside
+// them.
+func (self Class) brackets() string {
+	var b strings.Builder
+	b.WriteByte('[')
+	if self.Negate {
+		b.WriteByte('^')
+	}
+	for _, r := range self.Ranges {
+		b.WriteString(escapeChar(r.Lo, `\[]-^&`))
+		if r.Hi != r.Lo {
+			b.WriteByte('-')
+			b.WriteString(escapeChar(r.Hi, `\[]-^&`))
+		}
+	}
+	for _, x := range self.In {
+		b.WriteString(`\p{` + x + `}`)
+	}
+	for _, x := range self.Out {
+		b.WriteString(`\P{` + x + `}`)
+	}
+	for _, x := range self.Nested {
+		b.WriteString(x.brackets())
+	}
+	for _, x := range self.Ops {
+		if x.Op == Intersect {
+			b.WriteString("&&")
+		} else {
+			b.WriteString("--")
+		}
+		b.WriteString(x.Class.brackets())
+	}
+	b.WriteByte(']')
+	return b.String()
+}
+
+func (self Concat) String() string {
+	var b strings.Builder
+	for _, x := range self {
+		if alt, ok := x.(Alt); ok && len(alt) != 1 {
+			b.WriteString("(?:" + x.String() + ")")
+		} else {
+			b.WriteString(x.String())
+		}
+	}
+	return b.String()
+}
+
+func (self Alt) String() string {
+	parts := make([]string, len(self))
+	for i, x := range self {
+		parts[i] = x.String()
+		if alt, ok := x.(Alt); ok && len(alt) != 1 {
+			parts[i] = "(?:" + parts[i] + ")"
+		}
+	}
+	return strings.Join(parts, "|")
+}
+
+// Whether a node can have a modifier put straight after it.
+func simple(n Node) bool {
+	switch n := n.(type) {
+	case Concat:
+		return len(n) == 1 && simple(n[0])
+	case Alt:
+		return len(n) == 1 && simple(n[0])
+	case Repeat:
+		return false
+	}
+	return true
+}
+
+func (self Repeat) String() string {
+	sub := self.Sub.String()
+	if !simple(self.Sub) {
+		sub = "(?:" + sub + ")"
+	}
+	if self.Lazy {
+		return self.modifier(sub) + "?"
+	}
+	return self.modifier(sub)
+}
+
+func (self Repeat) modifier(sub string) string {
+	switch {
+	case self.Min == 0 && self.Max == 1:
+		return sub + "?"
+	case self.Min == 0 && self.Max == -1:
+		return sub + "*"
+	case self.Min == 1 && self.Max == -1:
+		return sub + "+"
+	case self.Min == self.Max:
+		return fmt.Sprintf("%s{%d}", sub, self.Min)
+	case self.Max == -1:
+		return fmt.Sprintf("%s{%d,}", sub, self.Min)
+	}
+	return fmt.Sprintf("%s{%d,%d}", sub, self.Min, self.Max)
+}
+
+func (self Group) String() string {
+	if self.Name != "" {
+		return "(?P<" + self.Name + ">" + self.Sub.String() + ")"
+	}
+	return "(" + self.Sub.String() + ")"
+}
+
+func (self Anchor) String() string {
+	switch self.Kind {
+	case BeginText:
+		return "^"
+	case EndText:
+		return "$"
+	case BeginLine:
+		return "(?m:^)"
+	case EndLine:
+		return "(?m:$)"
+	case WordBoundary:
+		return `\b`
+	case NotWordBoundary:
+		return `\B`
+	}
+	return "(?:)"
+}
+
+func (self Trailing) String() string {
+	return self.Sub.String() + "/" + self.Context.String()
+}
+
+/* Errors */
+
+// A problem with a regular expression, and where it was found.
+type RegexError struct {
+	Expr string
+	// how far into the expression the problem is, in runes
+	Pos int
+	Msg string
+}
+
+func (self *RegexError) Error() string {
+	return fmt.Sprintf("%s at position %d\n%s", self.Msg, self.Pos, self.Snippet())
+}
+
+// The expression, with a caret on the line below pointing out the problem.
+func (self *RegexError) Snippet() string {
+	rs := []rune(self.Expr)
+	pad := make([]rune, 0, self.Pos)
+	for i := 0; i < self.Pos && i < len(rs); i++ {
+		if rs[i] == '\t' {
+			pad = append(pad, '\t')
+		} else {
+			pad = append(pad, ' ')
+		}
+	}
+	return self.Expr + "\n" + string(pad) + "^"
+}
+
+/* Parsing */
+
+// escapes that stand for characters that are awkward to write
+var controlEscapes = map[rune]rune{
+	'n': '\n',
+	't': '\t',
+	'r': '\r',
+}
+
+// Flags that alter the meaning of parts of an expression.
+const (
+	// ^ and $ match at the beginning and end of lines as well as of the input
+	flagMultiline = 1 << iota
+	// letters match regardless of case
+	flagFold
+)
+
+var flagNames = map[rune]int{
+	'm': flagMultiline,
+	'i': flagFold,
+}
+
+// What an opening bracket begins.
+type groupSpec struct {
+	name    string
+	capture bool
+	// the flags in force inside the group
+	flags int
+	// a bare (?flags) sets the flags for the rest of the enclosing group,
+	// rather than opening a new one
+	bare bool
+	// how much of the input following the bracket the prefix takes up
+	size int
+}
+
+// Work out what kind of group is being opened, given the input following the
+// bracket and the flags currently in force.
+func groupPrefix(rs []rune, flags int) (groupSpec, error) {
+	if len(rs) == 0 || rs[0] != '?' {
+		return groupSpec{"", true, flags, false, 0}, nil
+	}
+	if len(rs) > 2 && rs[1] == 'P' && rs[2] == '<' {
+		for i := 3; i < len(rs); i++ {
+			c := rs[i]
+			if c == '>' {
+				if i == 3 {
+					return groupSpec{}, errors.New("empty group name")
+				}
+				return groupSpec{string(rs[3:i]), true, flags, false, i + 1}, nil
+			}
+			if !(c == '_' || unicode.IsLetter(c) || unicode.IsDigit(c)) {
+				return groupSpec{}, errors.New("invalid group name")
+			}
+		}
+		return groupSpec{}, errors.New("unclosed group name")
+	}
+	// flags, e.g. (?m) or (?m-i:...)
+	neg := false
+	for i := 1; i < len(rs); i++ {
+		switch c := rs[i]; c {
+		case ':':
+			return groupSpec{"", false, flags, false, i + 1}, nil
+		case ')':
+			return groupSpec{"", false, flags, true, i + 1}, nil
+		case '-':
+			if neg {
+				return groupSpec{}, errors.New("invalid flags")
+			}
+			neg = true
+		default:
+			f, ok := flagNames[c]
+			if !ok {
+				return groupSpec{}, errors.New("unknown group type")
+			}
+			if neg {
+				flags &^= f
+			} else {
+				flags |= f
+			}
+		}
+	}
+	return groupSpec{}, errors.New("unclosed group")
+}
+
+// Parse the name of a Unicode class, as in \pL or \p{Greek}, given the input
+// following the p. Returns the name and how much of the input it takes up.
+func unicodeClass(rs []rune) (string, int, error) {
+	if len(rs) == 0 {
+		return "", 0, errors.New("missing unicode class")
+	}
+	name, n := string(rs[0]), 1
+	if rs[0] == '{' {
+		n = 0
+		for i, c := range rs {
+			if c == '}' {
+				name, n = string(rs[1:i]), i+1
+				break
+			}
+		}
+		if n == 0 {
+			return "", 0, errors.New("unclosed unicode class")
+		}
+	}
+	if unicodeTable(name) == nil {
+		return "", 0, errors.New("unknown unicode class: " + name)
+	}
+	return name, n, nil
+}
+
+func unicodeTable(name string) *unicode.RangeTable {
+	if t, ok := unicode.Categories[name]; ok {
+		return t
+	}
+	return unicode.Scripts[name]
+}
+
+// the most that a count may specify
+const maxRepeat = 1000
+
+func isDigit(c rune) bool {
+	return '0' <= c && c <= '9'
+}
+
+// Parse the count in {n}, {n,} or {n,m}, given the input following the
+// brace. Returns the minimum and maximum (-1 if there is no maximum), and how
+// much of the input the count takes up.
+func repeatCount(rs []rune) (int, int, int, error) {
+	i := 0
+	num := func() int {
+		res := 0
+		for ; i < len(rs) && isDigit(rs[i]); i++ {
+			if res <= maxRepeat {
+				res = res*10 + int(rs[i]-'0')
+			}
+		}
+		return res
+	}
+	min := num()
+	max := min
+	if i < len(rs) && rs[i] == ',' {
+		i++
+		max = -1
+		if i < len(rs) && isDigit(rs[i]) {
+			max = num()
+		}
+	}
+	if i == len(rs) {
+		return 0, 0, 0, errors.New("unclosed repeat count")
+	}
+	if rs[i] != '}' {
+		return 0, 0, 0, errors.New("invalid repeat count")
+	}
+	if err := checkRepeat(min, max); err != nil {
+		return 0, 0, 0, err
+	}
+	return min, max, i + 1, nil
+}
+
+// How many times a repeat makes a copy of what is inside it.
+func (self Repeat) count() int {
+	if self.Max < 0 {
+		return max(self.Min, 1)
+	}
+	return max(self.Max, 1)
+}
+
+// How many copies of the most repeated part of a node its repeats make. The
+// counts of repeats inside one another multiply.
+func copies(n Node) int {
+	res := 1
+	switch n := n.(type) {
+	case Concat:
+		for _, x := range n {
+			res = max(res, copies(x))
+		}
+	case Alt:
+		for _, x := range n {
+			res = max(res, copies(x))
+		}
+	case Group:
+		res = copies(n.Sub)
+	case Repeat:
+		res = n.count() * copies(n.Sub)
+	case Trailing:
+		res = max(copies(n.Sub), copies(n.Context))
+	}
+	return res
+}
+
+func checkRepeat(min, max int) error {
+	if min < 0 || max < -1 {
+		return errors.New("invalid repeat count")
+	}
+	if min > maxRepeat || max > maxRepeat {
+		return errors.New("repeat count too large")
+	}
+	if max != -1 && max < min {
+		return errors.New("repeat count maximum less than minimum")
+	}
+	return nil
+}
+
+// Parse a charset in the notation that RegexSet and Charset use: a list of
+// characters and ranges like a-z, all inverted by a leading ^. A - at either
+// end stands for itself.
+func parseSpec(spec string) (Class, error) {
+	res := Class{}
+	rs := []rune(spec)
+	if len(rs) > 0 && rs[0] == '^' {
+		res.Negate = true
+		rs = rs[1:]
+	}
+	for i := 0; i < len(rs); i++ {
+		lo := rs[i]
+		if i+2 < len(rs) && rs[i+1] == '-' {
+			hi := rs[i+2]
+			if hi < lo {
+				return Class{}, errors.New("invalid range specification")
+			}
+			res.Ranges = append(res.Ranges, ClassRange{lo, hi})
+			i += 2
+			continue
+		}
+		res.Ranges = append(res.Ranges, ClassRange{lo, lo})
+	}
+	return res, nil
+}
+
+type parser struct {
+	expr   string
+	rs     []rune
+	pos    int
+	meta   RegexSet
+	flags  int
+	groups int
+	// whether / marks trailing context, rather than matching itself
+	trailing bool
+}
+
+// Parse a regular expression into a syntax tree. m gives the meanings of
+// metacharacters, as for AddRegex. Errors are returned as *RegexError.
+func ParseRegex(re string, m RegexSet) (Node, error) {
+	return parse(re, m, false)
+}
+
+// Parse a lexer rule into a syntax tree. Rules are regular expressions, except
+// that an unescaped / outside of any brackets marks the start of trailing
+// context, as in flex: r/s matches r, but only where s follows it.
+func ParseRule(re string, m RegexSet) (Node, error) {
+	return parse(re, m, true)
+}
+
+func parse(re string, m RegexSet, trailing bool) (Node, error) {
+	if m == nil {
+		m = defaultMeta
+	}
+	p := &parser{expr: re, rs: []rune(re), meta: m, trailing: trailing}
+	res, err := p.alt()
+	if err != nil {
+		return nil, err
+	}
+	if trailing && p.peek() == '/' {
+		if c, ok := res.(Concat); ok && len(c) == 0 {
+			return nil, p.fail(p.pos, "missing expression before trailing context")
+		}
+		p.pos++
+		context, err := p.alt()
+		if err != nil {
+			return nil, err
+		}
+		if c, ok := context.(Concat); ok && len(c) == 0 {
+			return nil, p.fail(p.pos, "missing trailing context")
+		}
+		if p.peek() == '/' {
+			return nil, p.fail(p.pos, "more than one trailing context")
+		}
+		res = Trailing{res, context}
+	}
+	if p.more() {
+		// the only thing that stops an alternation early
+		return nil, p.fail(p.pos, "trying to close unopened subexpr")
+	}
+	return res, nil
+}
+
+func (self *parser) fail(pos int, msg string) error {
+	return &RegexError{self.expr, pos, msg}
+}
+
+func (self *parser) more() bool {
+	return self.pos < len(self.rs)
+}
+
+func (self *parser) peek() rune {
+	if self.more() {
+		return self.rs[self.pos]
+	}
+	return FAIL
+}
+
+func (self *parser) literal(c rune) Node {
+	fold := self.flags&flagFold != 0 && unicode.SimpleFold(c) != c
+	return Literal{c, fold}
+}
+
+// alternatives, up to the end of the current group
+func (self *parser) alt() (Node, error) {
+	res := Alt{}
+	for {
+		n, err := self.concat()
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, n)
+		if self.peek() != '|' {
+			break
+		}
+		self.pos++
+	}
+	if len(res) == 1 {
+		return res[0], nil
+	}
+	return res, nil
+}
+
+// one alternative
+func (self *parser) concat() (Node, error) {
+	res := Concat{}
+	for self.more() && self.peek() != '|' && self.peek() != ')' && !(self.trailing && self.peek() == '/') {
+		n, err := self.atom()
+		if err != nil {
+			return nil, err
+		}
+		if n == nil {
+			// flags were set
+			continue
+		}
+		n, err = self.modifier(n)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, n)
+	}
+	if len(res) == 1 {
+		return res[0], nil
+	}
+	return res, nil
+}
+
+func (self *parser) atom() (Node, error) {
+	start := self.pos
+	c := self.rs[self.pos]
+	self.pos++
+	switch c {
+	case '(':
+		return self.group(start)
+	case '[':
+		return self.class(start)
+	case ']':
+		return nil, self.fail(start, "trying to close unopened charset")
+	case '.':
+		return AnyChar{}, nil
+	case '^', '$':
+		multi := self.flags&flagMultiline != 0
+		switch {
+		case c == '^' && multi:
+			return Anchor{BeginLine}, nil
+		case c == '^':
+			return Anchor{BeginText}, nil
+		case multi:
+			return Anchor{EndLine}, nil
+		}
+		return Anchor{EndText}, nil
+	case '?', '*', '+':
+		return nil, self.fail(start, "nothing to modify")
+	case '{':
+		// a brace that doesn't start a count is just a brace
+		if isDigit(self.peek()) {
+			return nil, self.fail(start, "nothing to modify")
+		}
+	case '\\':
+		return self.escape(start)
+	}
+	return self.literal(c), nil
+}
+
+func (self *parser) escape(start int) (Node, error) {
+	if !self.more() {
+		return nil, self.fail(start, "invalid escape sequence")
+	}
+	c := self.rs[self.pos]
+	self.pos++
+	meta, isMeta := self.meta[c]
+	fold := self.flags&flagFold != 0
+	switch {
+	case isMeta:
+		res, err := parseSpec(meta)
+		if err != nil {
+			return nil, self.fail(start, err.Error())
+		}
+		res.Fold = fold
+		return res, nil
+	case c == 'p' || c == 'P':
+		name, n, err := unicodeClass(self.rs[self.pos:])
+		if err != nil {
+			return nil, self.fail(start, err.Error())
+		}
+		self.pos += n
+		res := Class{Fold: fold}
+		if c == 'p' {
+			res.In = []string{name}
+		} else {
+			res.Out = []string{name}
+		}
+		return res, nil
+	case c == 'b':
+		return Anchor{WordBoundary}, nil
+	case c == 'B':
+		return Anchor{NotWordBoundary}, nil
+	}
+	if x, ok := controlEscapes[c]; ok {
+		c = x
+	}
+	// nothing else going on? well you escaped it for a reason
+	return self.literal(c), nil
+}
+
+func (self *parser) group(start int) (Node, error) {
+	g, err := groupPrefix(self.rs[self.pos:], self.flags)
+	if err != nil {
+		return nil, self.fail(start, err.Error())
+	}
+	self.pos += g.size
+	if g.bare {
+		self.flags = g.flags
+		return nil, nil
+	}
+	outer := self.flags
+	self.flags = g.flags
+	index := 0
+	if g.capture {
+		self.groups++
+		index = self.groups
+	}
+	sub, err := self.alt()
+	if err != nil {
+		return nil, err
+	}
+	if !self.more() {
+		return nil, self.fail(start, "unclosed subexpr")
+	}
+	if self.trailing && self.peek() == '/' {
+		return nil, self.fail(self.pos, "trailing context inside subexpr")
+	}
+	self.pos++
+	self.flags = outer
+	if g.capture {
+		return Group{sub, index, g.name}, nil
+	}
+	return sub, nil
+}
+
+func (self *parser) class(start int) (Node, error) {
+	res, err := self.classBody(start)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// The inside of a charset, following the bracket at start.
+func (self *parser) classBody(start int) (Class, error) {
+	fold := self.flags&flagFold != 0
+	res := Class{Fold: fold}
+	if self.peek() == '^' {
+		res.Negate = true
+		self.pos++
+	}
+	// where the characters go: into the charset itself, until an operator
+	// turns up, and then into the operand
+	items := &res
+	// where the last operator was, for when it's missing an operand
+	last := -1
+	for {
+		if !self.more() {
+			return Class{}, self.fail(start, "unclosed charset")
+		}
+		if self.peek() == ']' {
+			if last != -1 && items.empty() {
+				return Class{}, self.fail(last, "missing operand after "+string(self.rs[last:last+2]))
+			}
+			self.pos++
+			break
+		}
+		at := self.pos
+		if op, ok := self.setOp(); ok {
+			if items.empty() {
+				return Class{}, self.fail(at, "missing operand before "+string(self.rs[at:at+2]))
+			}
+			last = at
+			res.Ops = append(res.Ops, ClassOp{op, Class{Fold: fold}})
+			items = &res.Ops[len(res.Ops)-1].Class
+			continue
+		}
+		if self.peek() == '[' {
+			open := self.pos
+			self.pos++
+			sub, err := self.classBody(open)
+			if err != nil {
+				return Class{}, err
+			}
+			items.Nested = append(items.Nested, sub)
+			continue
+		}
+		lo, ok, err := self.classChar(items)
+		if err != nil {
+			return Class{}, err
+		}
+		if !ok {
+			continue
+		}
+		hi := lo
+		if self.peek() == '-' && self.pos+1 < len(self.rs) && self.rs[self.pos+1] != ']' && self.rs[self.pos+1] != '-' {
+			dash := self.pos
+			self.pos++
+			hi, ok, err = self.classChar(items)
+			if err != nil {
+				return Class{}, err
+			}
+			if !ok || hi < lo {
+				return Class{}, self.fail(dash, "invalid range specification")
+			}
+		}
+		items.Ranges = append(items.Ranges, ClassRange{lo, hi})
+	}
+	// an operand that is just a charset in brackets is that charset
+	for i, x := range res.Ops {
+		c := x.Class
+		if len(c.Nested) == 1 && c.Ranges == nil && c.In == nil && c.Out == nil && c.Ops == nil {
+			res.Ops[i].Class = c.Nested[0]
+		}
+	}
+	return res, nil
+}
+
+// Whether nothing has been put into a charset yet.
+func (self *Class) empty() bool {
+	return self.Ranges == nil && self.Nested == nil && self.In == nil && self.Out == nil
+}
+
+// An operator between sets, && or --.
+func (self *parser) setOp() (SetOp, bool) {
+	if self.pos+1 >= len(self.rs) || self.rs[self.pos] != self.rs[self.pos+1] {
+		return 0, false
+	}
+	switch self.rs[self.pos] {
+	case '&':
+		self.pos += 2
+		return Intersect, true
+	case '-':
+		self.pos += 2
+		return Subtract, true
+	}
+	return 0, false
+}
+
+// A character inside a charset. Unicode classes are added to the charset
+// directly, in which case there is no character.
+func (self *parser) classChar(res *Class) (rune, bool, error) {
+	start := self.pos
+	c := self.rs[self.pos]
+	self.pos++
+	if c != '\\' {
+		return c, true, nil
+	}
+	if !self.more() {
+		return 0, false, self.fail(start, "invalid escape sequence")
+	}
+	c = self.rs[self.pos]
+	self.pos++
+	if c == 'p' || c == 'P' {
+		name, n, err := unicodeClass(self.rs[self.pos:])
+		if err != nil {
+			return 0, false, self.fail(start, err.Error())
+		}
+		self.pos += n
+		if c == 'p' {
+			res.In = append(res.In, name)
+		} else {
+			res.Out = append(res.Out, name)
+		}
+		return 0, false, nil
+	}
+	if x, ok := controlEscapes[c]; ok {
+		c = x
+	}
+	return c, true, nil
+}
+
+func (self *parser) modifier(n Node) (Node, error) {
+	start := self.pos
+	min, max := 0, 0
+	switch self.peek() {
+	case '?':
+		self.pos++
+		min, max = 0, 1
+	case '*':
+		self.pos++
+		min, max = 0, -1
+	case '+':
+		self.pos++
+		min, max = 1, -1
+	case '{':
+		if self.pos+1 >= len(self.rs) || !isDigit(self.rs[self.pos+1]) {
+			return n, nil
+		}
+		var size int
+		var err error
+		min, max, size, err = repeatCount(self.rs[self.pos+1:])
+		if err != nil {
+			return nil, self.fail(start, err.Error())
+		}
+		self.pos += size + 1
+	default:
+		return n, nil
+	}
+	// a following ? makes it lazy
+	lazy := self.peek() == '?'
+	if lazy {
+		self.pos++
+	}
+	res := Repeat{n, min, max, lazy}
+	if copies(res) > maxRepeat {
+		return nil, self.fail(start, "nested repeat counts too large")
+	}
+	return res, nil
+}
@@ -0,0 +1,446 @@
+package lexer
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"unicode"
+)
+
+/* DFA tables */
+
+// A Table is the DFA for a Lexer's rules worked out in full, rather than as
+// the input demands it. It is meant for writing out lexers ahead of time.
+//
+// The DFA is minimised, so that no two states behave the same way, and its
+// alphabet is compressed: the runes are put into classes, such that every
+// state treats all of the runes in a class alike. The transitions are then
+// given twice over, once as ranges of runes for each state, and once as a
+// single array indexed by state and class.
+type Table struct {
+	States []TableState
+	// the state that each mode starts in
+	Modes map[string]int
+	// sorted, non-overlapping ranges of runes and the classes they are in;
+	// runes outside of these lead nowhere from any state
+	Classes    []TableClass
+	NumClasses int
+	// where state s goes on a rune of class c is Next[s*NumClasses+c], or
+	// FAIL if it goes nowhere
+	Next []int
+	// the final state each state matches, for actions and the like
+	rules []State
+}
+
+type TableState struct {
+	// the identifier of the token matched on reaching this state, or FAIL
+	Final int
+	// what happens to the mode stack when the token is matched
+	Pop, Push bool
+	Mode      string
+	// how many runes of trailing context to give back when the token is
+	// matched
+	Trail int
+	// sorted, non-overlapping ranges of runes and where they lead
+	Trans []TableTrans
+}
+
+type TableTrans struct {
+	Lo, Hi rune
+	To     int
+}
+
+type TableClass struct {
+	Lo, Hi rune
+	Class  int
+}
+
+// Where a state goes on a rune, or FAIL.
+func (self *Table) step(s int, c rune) int {
+	i := sort.Search(len(self.Classes), func(i int) bool {
+		return self.Classes[i].Hi >= c
+	})
+	if i == len(self.Classes) || self.Classes[i].Lo > c {
+		return FAIL
+	}
+	return self.Next[s*self.NumClasses+self.Classes[i].Class]
+}
+
+// Work out the DFA for every mode of the Lexer. Assertions cannot be put into
+// tables, and neither can trailing context that varies in length, or states
+// from outside this package. Actions are code
+// rather than data, so they are left out.
+func (self *Lexer) Table() (*Table, error) {
+	return buildTable(self.modes, 0)
+}
+
+var errTooBig = errors.New("too many states")
+
+// Work out the DFA for some modes, giving up if it has more than limit states
+// (unless limit is 0).
+func buildTable(modes map[string]*BasicState, limit int) (*Table, error) {
+	var err error
+	for _, root := range modes {
+		walk(root, func(s State) {
+			switch s := s.(type) {
+			case *BasicState:
+				if s.trail == FAIL {
+					err = errors.New("trailing context that varies in length cannot be put into tables")
+				}
+			case *SpecialState, *csState, *capState:
+			case *assertState:
+				err = errors.New("assertions cannot be put into tables")
+			default:
+				err = fmt.Errorf("states of type %T cannot be put into tables", s)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	res := &Table{Modes: make(map[string]int)}
+	d := newDfa()
+	ids := make(map[string]int)
+	sets := [][]State{}
+
+	add := func(set []State) int {
+		key := d.key(set)
+		if id, ok := ids[key]; ok {
+			return id
+		}
+		id := len(res.States)
+		ids[key] = id
+		rule, final := finished(set)
+		st := TableState{Final: final}
+		if s, ok := rule.(*BasicState); ok {
+			st.Pop, st.Push, st.Mode = s.change.pop, s.change.push, s.change.mode
+			st.Trail = s.trail
+		}
+		res.States = append(res.States, st)
+		res.rules = append(res.rules, rule)
+		sets = append(sets, set)
+		return id
+	}
+
+	names := make([]string, 0, len(modes))
+	for name := range modes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		res.Modes[name] = add(close([]State{modes[name]}, nil))
+	}
+
+	for i := 0; i < len(sets); i++ {
+		if limit != 0 && len(sets) > limit {
+			return nil, errTooBig
+		}
+		set := sets[i]
+		bounds := boundaries(set)
+		trans := []TableTrans{}
+		for j := 0; j < len(bounds)-1; j++ {
+			lo, hi := bounds[j], bounds[j+1]-1
+			next := move(set, lo)
+			if len(next) == 0 {
+				continue
+			}
+			to := add(close(next, nil))
+			if l := len(trans); l > 0 && trans[l-1].Hi+1 == lo && trans[l-1].To == to {
+				trans[l-1].Hi = hi
+				continue
+			}
+			trans = append(trans, TableTrans{lo, hi, to})
+		}
+		res.States[i].Trans = trans
+	}
+
+	res.compress()
+	res.minimise()
+	res.compress()
+	return res, nil
+}
+
+/* Alphabet compression */
+
+// Work out the classes of runes from the transitions of the states, and fill
+// in Next.
+func (self *Table) compress() {
+	// the points where some state's transitions change
+	points := map[rune]bool{}
+	for _, st := range self.States {
+		for _, t := range st.Trans {
+			points[t.Lo] = true
+			points[t.Hi+1] = true
+		}
+	}
+	bounds := make([]rune, 0, len(points))
+	for c := range points {
+		bounds = append(bounds, c)
+	}
+	sort.Slice(bounds, func(i, j int) bool {
+		return bounds[i] < bounds[j]
+	})
+
+	// what each state does on each stretch between the points
+	n := len(bounds) - 1
+	if n < 0 {
+		n = 0
+	}
+	columns := make([][]int, n)
+	for i := range columns {
+		columns[i] = make([]int, len(self.States))
+	}
+	for s, st := range self.States {
+		j := 0
+		for i := 0; i < n; i++ {
+			for j < len(st.Trans) && st.Trans[j].Hi < bounds[i] {
+				j++
+			}
+			columns[i][s] = FAIL
+			if j < len(st.Trans) && st.Trans[j].Lo <= bounds[i] {
+				columns[i][s] = st.Trans[j].To
+			}
+		}
+	}
+
+	// stretches that are treated the same way everywhere share a class
+	self.Classes = nil
+	self.Next = nil
+	keys := make(map[string]int)
+	var order [][]int
+	for i, col := range columns {
+		dead := true
+		for _, x := range col {
+			if x != FAIL {
+				dead = false
+				break
+			}
+		}
+		if dead {
+			continue
+		}
+		key := fmt.Sprint(col)
+		c, ok := keys[key]
+		if !ok {
+			c = len(order)
+			keys[key] = c
+			order = append(order, col)
+		}
+		lo, hi := bounds[i], bounds[i+1]-1
+		if l := len(self.Classes); l > 0 && self.Classes[l-1].Hi+1 == lo && self.Classes[l-1].Class == c {
+			self.Classes[l-1].Hi = hi
+			continue
+		}
+		self.Classes = append(self.Classes, TableClass{lo, hi, c})
+	}
+	self.NumClasses = len(order)
+	self.Next = make([]int, len(self.States)*self.NumClasses)
+	for c, col := range order {
+		for s, x := range col {
+			self.Next[s*self.NumClasses+c] = x
+		}
+	}
+}
+
+/* Minimisation */
+
+// Merge the states that behave the same way, by Hopcroft's algorithm. The
+// states start off split up by what they match, and the groups are split
+// further until all of the states in a group lead to the same groups on every
+// class. Needs Next to be filled in.
+func (self *Table) minimise() {
+	n, k := len(self.States), self.NumClasses
+	// an extra state, dead, stands in for FAIL
+	dead := n
+	next := func(s, c int) int {
+		if s == dead {
+			return dead
+		}
+		if t := self.Next[s*k+c]; t != FAIL {
+			return t
+		}
+		return dead
+	}
+
+	// where each state can be reached from, and on which class
+	type edge struct{ from, class int }
+	pre := make([][]edge, n+1)
+	for s := 0; s <= n; s++ {
+		for c := 0; c < k; c++ {
+			t := next(s, c)
+			pre[t] = append(pre[t], edge{s, c})
+		}
+	}
+
+	// the initial groups
+	block := make([]int, n+1)
+	var blocks [][]int
+	keys := make(map[string]int)
+	for s := 0; s <= n; s++ {
+		key := fmt.Sprint(FAIL, false, false, "", 0)
+		if s != dead {
+			key = self.stateKey(s)
+		}
+		b, ok := keys[key]
+		if !ok {
+			b = len(blocks)
+			keys[key] = b
+			blocks = append(blocks, nil)
+		}
+		block[s] = b
+		blocks[b] = append(blocks[b], s)
+	}
+
+	// the groups still to split the others by
+	waiting := make([]int, len(blocks))
+	queued := make([]bool, len(blocks))
+	for b := range blocks {
+		waiting[b], queued[b] = b, true
+	}
+
+	marked := make([]bool, n+1)
+	count := make([]int, len(blocks))
+	for len(waiting) > 0 {
+		a := waiting[len(waiting)-1]
+		waiting = waiting[:len(waiting)-1]
+		queued[a] = false
+		// the states that lead into a on each class
+		into := make([][]int, k)
+		for _, t := range blocks[a] {
+			for _, e := range pre[t] {
+				into[e.class] = append(into[e.class], e.from)
+			}
+		}
+		for _, xs := range into {
+			touched := []int{}
+			for _, s := range xs {
+				if marked[s] {
+					continue
+				}
+				marked[s] = true
+				b := block[s]
+				if count[b] == 0 {
+					touched = append(touched, b)
+				}
+				count[b]++
+			}
+			for _, b := range touched {
+				if count[b] < len(blocks[b]) {
+					// split off the marked states
+					nb := len(blocks)
+					var in, out []int
+					for _, s := range blocks[b] {
+						if marked[s] {
+							in = append(in, s)
+							block[s] = nb
+						} else {
+							out = append(out, s)
+						}
+					}
+					blocks[b] = out
+					blocks = append(blocks, in)
+					count = append(count, 0)
+					queued = append(queued, false)
+					if queued[b] || len(in) <= len(out) {
+						waiting = append(waiting, nb)
+						queued[nb] = true
+					} else {
+						waiting = append(waiting, b)
+						queued[b] = true
+					}
+				}
+				count[b] = 0
+			}
+			for _, s := range xs {
+				marked[s] = false
+			}
+		}
+	}
+
+	// number the groups by their first state, so that the order is kept; the
+	// group with the dead state in it only needs to stay if a mode starts
+	// there
+	starts := make(map[int]bool)
+	for _, s := range self.Modes {
+		starts[block[s]] = true
+	}
+	renum := make([]int, len(blocks))
+	for b := range renum {
+		renum[b] = FAIL
+	}
+	var states []TableState
+	var rules []State
+	for s := 0; s < n; s++ {
+		b := block[s]
+		if renum[b] != FAIL || b == block[dead] && !starts[b] {
+			continue
+		}
+		renum[b] = len(states)
+		states = append(states, self.States[s])
+		rules = append(rules, self.rules[s])
+	}
+	for i, st := range states {
+		trans := []TableTrans{}
+		for _, t := range st.Trans {
+			to := renum[block[t.To]]
+			if block[t.To] == block[dead] {
+				continue
+			}
+			if l := len(trans); l > 0 && trans[l-1].Hi+1 == t.Lo && trans[l-1].To == to {
+				trans[l-1].Hi = t.Hi
+				continue
+			}
+			trans = append(trans, TableTrans{t.Lo, t.Hi, to})
+		}
+		states[i].Trans = trans
+	}
+	for name, s := range self.Modes {
+		self.Modes[name] = renum[block[s]]
+	}
+	self.States, self.rules = states, rules
+}
+
+// What a state does when the input stops there: states that differ in this
+// can never be merged.
+func (self *Table) stateKey(s int) string {
+	st := self.States[s]
+	key := fmt.Sprint(st.Final, st.Pop, st.Push, st.Mode, st.Trail)
+	if b, ok := self.rules[s].(*BasicState); ok && b.action != nil {
+		// actions can't be compared, so keep rules that have them apart
+		key += fmt.Sprintf(" %p", b)
+	}
+	return key
+}
+
+// The points at which the runes that lead out of a set of states change, in
+// order. Every rune between one point and the next leads to the same place.
+func boundaries(set []State) []rune {
+	points := map[rune]bool{}
+	addRange := func(lo, hi rune) {
+		points[lo] = true
+		points[hi+1] = true
+	}
+	for _, x := range set {
+		switch x := x.(type) {
+		case *BasicState:
+			for c := range x.transitions {
+				addRange(c, c)
+			}
+		case *SpecialState:
+			addRange(0, unicode.MaxRune)
+		case *csState:
+			for _, r := range x.set {
+				addRange(r.lo, r.hi)
+			}
+		}
+	}
+	res := make([]rune, 0, len(points))
+	for c := range points {
+		res = append(res, c)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i] < res[j]
+	})
+	return res
+}
@@ -0,0 +1,77 @@
+package lexer
+
+import (
+	"fmt"
+	"iter"
+)
+
+/* Tokens */
+
+// A token that the Lexer has matched. Unlike the Lexer itself, a Token
+// doesn't change when Next() is called, so it can be kept hold of.
+type Token struct {
+	ID    int
+	Text  string
+	Span  Span
+	Value any
+	// how far the Lexer looked into the input to match the token, and the mode
+	// stack it left behind, so that it can be matched again (see Relex)
+	look  int
+	after *modeStack
+}
+
+func (self Token) String() string {
+	return fmt.Sprintf("%d %q at %s", self.ID, self.Text, self.Span)
+}
+
+// Input that none of the rules match, found at Loc.
+type MatchError struct {
+	Loc Location
+}
+
+func (self *MatchError) Error() string {
+	return fmt.Sprintf("no rule matches the input at %s", self.Loc)
+}
+
+// The tokens in the input, up to the end. If the input doesn't match, the
+// last thing produced is a *MatchError, and if it can't be read, it's the
+// error from the reader (or an action). With SetRecover on, input that doesn't match turns up
+// as tokens with an ID of ERROR instead.
+func (self *Scanner) Tokens() iter.Seq2[Token, error] {
+	return func(yield func(Token, error) bool) {
+		for {
+			id := self.Next()
+			switch {
+			case id == EOF:
+				return
+			case id == FAIL && self.err != nil:
+				yield(Token{}, self.err)
+				return
+			case id == FAIL:
+				yield(Token{}, &MatchError{self.loc})
+				return
+			}
+			tok := Token{id, self.String(), self.Span(), self.value, self.reach, self.stack}
+			if !yield(tok, nil) {
+				return
+			}
+		}
+	}
+}
+
+// Break a string up into tokens.
+func (self *Lexer) Tokenize(s string) ([]Token, error) {
+	self.StartString(s)
+	return collect(self.Tokens())
+}
+
+func collect(tokens iter.Seq2[Token, error]) ([]Token, error) {
+	var res []Token
+	for t, err := range tokens {
+		if err != nil {
+			return res, err
+		}
+		res = append(res, t)
+	}
+	return res, nil
+}
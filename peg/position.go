@@ -2,6 +2,7 @@ package peg
 
 import (
 	"io"
+	"strconv"
 
 	"github.com/bobappleyard/bwl/lexer"
 )
@@ -74,7 +75,7 @@ func (self *failure) Id() int {
 }
 
 func (self *failure) String() string {
-	return string(self.PosDefaults.pos)
+	return strconv.Itoa(self.PosDefaults.pos)
 }
 
 // A position object representing the end of input
@@ -96,6 +97,15 @@ func (self *eofObj) Id() int {
 	return -1
 }
 
+/*
+	Positions that know where they are in terms of lines and columns. Those
+	that come from NewLex do this, including when they fail, so the failure
+	can be reported to the user.
+*/
+type Spanned interface {
+	Span() lexer.Span
+}
+
 // connecting to the lexer library
 type lexPos struct {
 	PosDefaults
@@ -104,6 +114,7 @@ type lexPos struct {
 	next Position
 	id   int
 	data interface{}
+	span lexer.Span
 }
 
 func NewLex(in io.Reader, l *lexer.Lexer, pass func(int) bool) Position {
@@ -111,6 +122,7 @@ func NewLex(in io.Reader, l *lexer.Lexer, pass func(int) bool) Position {
 	res.l = l
 	l.Start(in)
 	res.pass = pass
+	res.span = l.Span()
 	return res.Next()
 }
 
@@ -122,7 +134,12 @@ func (self *lexPos) Next() Position {
 	for {
 		n = self.l.Next()
 		if n == lexer.EOF {
-			return EofObject
+			// the end of the input lies at the end of the last token
+			end := new(lexEof)
+			end.Init(self.span.End.Pos)
+			end.span = lexer.Span{Start: self.span.End, End: self.span.End}
+			self.next = end
+			return end
 		}
 		if self.pass(n) {
 			break
@@ -134,10 +151,61 @@ func (self *lexPos) Next() Position {
 	next.PosDefaults.pos = self.l.Pos()
 	next.id = n
 	next.data = self.l.String()
+	next.span = self.l.Span()
 	self.next = next
 	return next
 }
 
+func (self *lexPos) Fail() Position {
+	res := new(lexFailure)
+	res.Init(self.pos)
+	res.span = self.span
+	return res
+}
+
+func (self *lexPos) Span() lexer.Span {
+	return self.span
+}
+
+// The end of the input, when reached through a lexPos, so that running out of
+// input can be reported like any other failure.
+type lexEof struct {
+	eofObj
+	span lexer.Span
+}
+
+func (self *lexEof) Next() Position {
+	return self.Fail()
+}
+
+func (self *lexEof) Fail() Position {
+	res := new(lexFailure)
+	res.Init(self.pos)
+	res.span = self.span
+	return res
+}
+
+func (self *lexEof) Span() lexer.Span {
+	return self.span
+}
+
+type lexFailure struct {
+	failure
+	span lexer.Span
+}
+
+func (self *lexFailure) Next() Position {
+	return self
+}
+
+func (self *lexFailure) Fail() Position {
+	return self
+}
+
+func (self *lexFailure) Span() lexer.Span {
+	return self.span
+}
+
 func (self *lexPos) Id() int {
 	return self.id
 }